@@ -0,0 +1,94 @@
+// Command packdump prints the records of pack capture files.
+//
+// Usage:
+//
+//	packdump [-json] [-frame] capture...
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lkj01010/goutils/pack"
+)
+
+var (
+	asJSON    = flag.Bool("json", false, "print one JSON object per record")
+	withFrame = flag.Bool("frame", false, "parse records as frames with the extended header")
+)
+
+type record struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Length    int       `json:"len"`
+	Type      *uint16   `json:"type,omitempty"`
+	Flags     *uint16   `json:"flags,omitempty"`
+	Seq       *uint32   `json:"seq,omitempty"`
+	Data      []byte    `json:"data"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: packdump [-json] [-frame] capture...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, name := range flag.Args() {
+		if err := dump(name); err != nil {
+			fmt.Fprintf(os.Stderr, "packdump: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func dump(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr, err := pack.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	err = cr.Replay(0, func(r pack.Record) error {
+		out := record{
+			Time:      r.Time,
+			Direction: r.Direction.String(),
+			Length:    len(r.Data),
+			Data:      r.Data,
+		}
+		if *withFrame {
+			if fr, err := pack.ParseFrame(r.Data); err == nil {
+				out.Type, out.Flags, out.Seq = &fr.Type, &fr.Flags, &fr.Seq
+				out.Data = fr.Payload
+			}
+		}
+
+		if *asJSON {
+			return enc.Encode(out)
+		}
+		fmt.Printf("%s %-3s %6d", out.Time.Format(time.RFC3339Nano), out.Direction, out.Length)
+		if out.Type != nil {
+			fmt.Printf(" type=%d flags=%#04x seq=%d", *out.Type, *out.Flags, *out.Seq)
+		}
+		_, err := fmt.Printf(" %q\n", out.Data)
+		return err
+	})
+	if s := cr.Stats(); s.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, "packdump: %s: skipped %d damaged bytes\n", name, s.Skipped)
+	}
+	return err
+}
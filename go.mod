@@ -1,11 +1,13 @@
 module github.com/lkj01010/goutils
 
-go 1.13
+go 1.18
+
+require github.com/nats-io/go-nats v1.7.2
 
 require (
 	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/nats-io/gnatsd v1.4.1 // indirect
-	github.com/nats-io/go-nats v1.7.2
 	github.com/nats-io/nkeys v0.1.3 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
 )
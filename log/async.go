@@ -0,0 +1,213 @@
+package log
+
+import (
+	"os"
+	"sync"
+)
+
+// OverflowPolicy decides what an asynchronous Logger does with an entry
+// when its queue is full.
+type OverflowPolicy int
+
+const (
+	// Block makes the logging call wait for room.
+	Block OverflowPolicy = iota
+	// DropDebugFirst discards the oldest queued debug entry, or the new
+	// entry if it is debug, and blocks only when neither is possible.
+	DropDebugFirst
+	// DropNewest discards the new entry.
+	DropNewest
+)
+
+// queued is an entry with the outputs configured when it was logged, so the
+// drainer never needs the Logger's lock.
+type queued struct {
+	e         Entry
+	sinks     []*sink
+	formatter Formatter
+}
+
+type asyncQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ring    []queued
+	head, n int
+	policy  OverflowPolicy
+	dropped uint64
+	busy    bool // the drainer is writing entries it took off the ring
+	closed  bool
+	done    chan struct{}
+}
+
+// SetAsync makes l queue up to size entries and write them from a
+// background goroutine, so slow outputs do not stall the caller. Field
+// values are formatted later and must not change after logging.
+// Call Flush or Close before the program exits.
+func (l *Logger) SetAsync(size int, policy OverflowPolicy) {
+	if size < 1 {
+		size = 1
+	}
+	q := &asyncQueue{
+		ring:   make([]queued, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.async != nil {
+		l.async.close()
+	}
+	l.async = q
+	go q.drain()
+}
+
+// Flush waits until all queued entries are written.
+func (l *Logger) Flush() {
+	l = l.base()
+	l.mu.Lock()
+	q := l.async
+	l.mu.Unlock()
+	if q != nil {
+		q.flush()
+	}
+}
+
+// Close writes the queued entries and switches l back to writing
+// synchronously. It does not close the sinks.
+func (l *Logger) Close() error {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.async != nil {
+		l.async.close()
+		l.async = nil
+	}
+	return nil
+}
+
+// Dropped returns the number of entries discarded by the overflow policy.
+func (l *Logger) Dropped() uint64 {
+	l = l.base()
+	l.mu.Lock()
+	q := l.async
+	l.mu.Unlock()
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// exit flushes l and ends the program, for the Fatal functions.
+func (l *Logger) exit() {
+	l.Flush()
+	os.Exit(1)
+}
+
+func SetAsync(size int, policy OverflowPolicy) {
+	std.SetAsync(size, policy)
+}
+
+func Flush() {
+	std.Flush()
+}
+
+func Close() error {
+	return std.Close()
+}
+
+func Dropped() uint64 {
+	return std.Dropped()
+}
+
+func (q *asyncQueue) push(item queued) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == len(q.ring) {
+		switch {
+		case q.policy == DropNewest:
+			q.dropped++
+			return
+		case q.policy == DropDebugFirst && item.e.Level <= LevelDebug:
+			q.dropped++
+			return
+		case q.policy == DropDebugFirst && q.removeDebug():
+			q.dropped++
+		default:
+			q.cond.Wait()
+		}
+	}
+	q.ring[(q.head+q.n)%len(q.ring)] = item
+	q.n++
+	q.cond.Broadcast()
+}
+
+// removeDebug removes the oldest debug entry from the ring, if any.
+func (q *asyncQueue) removeDebug() bool {
+	for i := 0; i < q.n; i++ {
+		if q.ring[(q.head+i)%len(q.ring)].e.Level > LevelDebug {
+			continue
+		}
+		for ; i < q.n-1; i++ {
+			q.ring[(q.head+i)%len(q.ring)] = q.ring[(q.head+i+1)%len(q.ring)]
+		}
+		q.n--
+		q.ring[(q.head+q.n)%len(q.ring)] = queued{}
+		return true
+	}
+	return false
+}
+
+func (q *asyncQueue) drain() {
+	defer close(q.done)
+	var batch []queued
+	for {
+		q.mu.Lock()
+		for q.n == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.n == 0 {
+			q.mu.Unlock()
+			return
+		}
+		batch = batch[:0]
+		for ; q.n > 0; q.n-- {
+			batch = append(batch, q.ring[q.head])
+			q.ring[q.head] = queued{}
+			q.head = (q.head + 1) % len(q.ring)
+		}
+		q.busy = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		for i := range batch {
+			writeSinks(batch[i].sinks, batch[i].formatter, &batch[i].e)
+			batch[i] = queued{}
+		}
+
+		q.mu.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+func (q *asyncQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n > 0 || q.busy {
+		q.cond.Wait()
+	}
+}
+
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.done
+}
@@ -0,0 +1,178 @@
+package log
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedWriter records lines, holding every write until open is closed.
+type gatedWriter struct {
+	started chan struct{} // receives once a write is waiting
+	open    chan struct{}
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{started: make(chan struct{}, 1), open: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.open
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func (w *gatedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return strings.Join(w.lines, ",")
+}
+
+func (w *gatedWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.lines)
+}
+
+func newAsyncLogger(size int, policy OverflowPolicy) (*Logger, *gatedWriter) {
+	w := newGatedWriter()
+	l := New(w, "", 0, LevelDebug)
+	l.SetFormatter(&TextFormatter{})
+	l.SetAsync(size, policy)
+	return l, w
+}
+
+func TestAsyncOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		log     func(l *Logger)
+		dropped uint64
+		want    string
+	}{
+		{DropNewest, func(l *Logger) {
+			l.Infof("i2")
+			l.Debugf("d2")
+		}, 2, "[I]: first,[D]: d1,[I]: i1"},
+		{DropDebugFirst, func(l *Logger) {
+			l.Infof("i2") // replaces d1
+			l.Debugf("d2")
+		}, 2, "[I]: first,[I]: i1,[I]: i2"},
+	}
+	for _, tt := range tests {
+		l, w := newAsyncLogger(2, tt.policy)
+		l.Infof("first")
+		<-w.started // the drainer holds "first", the queue is empty
+		l.Debugf("d1")
+		l.Infof("i1")
+		tt.log(l)
+		if n := l.Dropped(); n != tt.dropped {
+			t.Errorf("policy %d: dropped %d, want %d", tt.policy, n, tt.dropped)
+		}
+		close(w.open)
+		l.Flush()
+		if got := w.String(); got != tt.want {
+			t.Errorf("policy %d: got %q, want %q", tt.policy, got, tt.want)
+		}
+		l.Close()
+	}
+}
+
+func TestAsyncBlock(t *testing.T) {
+	for _, policy := range []OverflowPolicy{Block, DropDebugFirst} {
+		l, w := newAsyncLogger(1, policy)
+		l.Infof("first")
+		<-w.started
+		l.Infof("i1")
+
+		// the queue is full of entries the policy may not drop
+		done := make(chan struct{})
+		go func() {
+			l.Infof("i2")
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatalf("policy %d: logging to a full queue did not block", policy)
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(w.open)
+		<-done
+		l.Flush()
+		if got, want := w.String(), "[I]: first,[I]: i1,[I]: i2"; got != want {
+			t.Errorf("policy %d: got %q, want %q", policy, got, want)
+		}
+		if n := l.Dropped(); n != 0 {
+			t.Errorf("policy %d: dropped %d", policy, n)
+		}
+		l.Close()
+	}
+}
+
+func TestAsyncFlushClose(t *testing.T) {
+	w := newGatedWriter()
+	close(w.open)
+	l := New(w, "", 0, LevelDebug)
+	l.SetFormatter(&TextFormatter{})
+	l.SetAsync(4, Block)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				l.Infof("x")
+			}
+		}()
+	}
+	wg.Wait()
+	l.Flush()
+	if n := w.count(); n != 200 {
+		t.Fatalf("Flush: %d entries written, want 200", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Infof("y")
+	}
+	l.Close()
+	if n := w.count(); n != 210 {
+		t.Fatalf("Close: %d entries written, want 210", n)
+	}
+	// writes are synchronous again
+	l.Infof("z")
+	if n := w.count(); n != 211 {
+		t.Fatalf("after Close: %d entries written, want 211", n)
+	}
+}
+
+func TestAsyncPanic(t *testing.T) {
+	w := newGatedWriter()
+	close(w.open)
+	l := New(w, "", 0, LevelDebug)
+	l.SetFormatter(&TextFormatter{})
+	l.SetAsync(16, Block)
+	defer l.Close()
+
+	for _, panics := range []func(){
+		func() { l.Panicf("p%d", 1) },
+		func() { l.With().Panic("p2") },
+	} {
+		func() {
+			defer func() { recover() }()
+			panics()
+		}()
+	}
+	if got, want := w.String(), "[P]: p1,[P]: p2"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
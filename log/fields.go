@@ -0,0 +1,120 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is a typed key-value pair attached to a structured log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field, for callers that prefer it to alternating keys and values.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Context writes structured entries through a Logger, each carrying the
+// Context's fields followed by its own.
+type Context struct {
+	l      *Logger
+	fields []Field
+}
+
+// With returns a Context whose entries carry the fields in kv. kv holds
+// alternating keys and values, or Fields.
+func (l *Logger) With(kv ...interface{}) *Context {
+	return &Context{l: l, fields: appendFields(nil, kv)}
+}
+
+// With returns a Context carrying c's fields and those in kv.
+func (c *Context) With(kv ...interface{}) *Context {
+	fields := c.fields[:len(c.fields):len(c.fields)]
+	return &Context{l: c.l, fields: appendFields(fields, kv)}
+}
+
+func (c *Context) Debug(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelDebug, 3, msg, c.fields, kv)
+}
+
+func (c *Context) Info(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelInfo, 3, msg, c.fields, kv)
+}
+
+func (c *Context) Warning(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelWarning, 3, msg, c.fields, kv)
+}
+
+func (c *Context) Error(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelError, 3, msg, c.fields, kv)
+}
+
+func (c *Context) Panic(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelPanic, 3, msg, c.fields, kv)
+	c.l.Flush()
+	panic(msg)
+}
+
+func (c *Context) Fatal(msg string, kv ...interface{}) {
+	c.l.outputFields(LevelFatal, 3, msg, c.fields, kv)
+	c.l.exit()
+}
+
+// With returns a Context of the standard logger.
+func With(kv ...interface{}) *Context {
+	return std.With(kv...)
+}
+
+func (l *Logger) outputFields(level, calldepth int, msg string, fields []Field, kv []interface{}) error {
+	r := l.base()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if level >= l.level {
+		if len(kv) > 0 {
+			fields = appendFields(fields[:len(fields):len(fields)], kv)
+		}
+		return l.write(level, calldepth+1, msg, fields)
+	}
+	return nil
+}
+
+// appendFields appends the key-value pairs and Fields in kv to dst. A value
+// without a key is logged under the key "!BADKEY".
+func appendFields(dst []Field, kv []interface{}) []Field {
+	for i := 0; i < len(kv); i++ {
+		switch k := kv[i].(type) {
+		case Field:
+			dst = append(dst, k)
+		case string:
+			if i+1 < len(kv) {
+				dst = append(dst, Field{Key: k, Value: kv[i+1]})
+				i++
+				continue
+			}
+			dst = append(dst, Field{Key: "!BADKEY", Value: k})
+		default:
+			dst = append(dst, Field{Key: "!BADKEY", Value: k})
+		}
+	}
+	return dst
+}
+
+// formatFields renders fields as " key=value" pairs, quoting values that
+// would be ambiguous.
+func formatFields(fields []Field) string {
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
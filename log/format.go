@@ -0,0 +1,154 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Entry is one log entry handed to a Formatter.
+type Entry struct {
+	Time    time.Time
+	Level   int
+	Name    string // of a named logger, or empty
+	File    string // empty if the caller is unknown
+	Line    int
+	Message string
+	Fields  []Field
+
+	// Prefix and Flags are those of the Logger, with the meaning they
+	// have for the standard log package.
+	Prefix string
+	Flags  int
+}
+
+// Formatter renders entries for a Logger.
+type Formatter interface {
+	// Format appends e to dst as one line, including the newline.
+	Format(dst []byte, e *Entry) []byte
+}
+
+// TextFormatter renders entries like the standard log package, as
+// "prefix date time file:line: [I]: name: message key=value".
+type TextFormatter struct {
+	// Color wraps every line in the ANSI color of its level.
+	Color bool
+}
+
+func (f *TextFormatter) Format(dst []byte, e *Entry) []byte {
+	if e.Flags&log.Lmsgprefix == 0 {
+		dst = append(dst, e.Prefix...)
+	}
+	dst = appendHeader(dst, e)
+	if e.Flags&log.Lmsgprefix != 0 {
+		dst = append(dst, e.Prefix...)
+	}
+	if f.Color {
+		dst = append(dst, levelColorPrefix(e.Level)...)
+	}
+	dst = append(dst, LevelName(e.Level)...)
+	dst = append(dst, ": "...)
+	if e.Name != "" {
+		dst = append(dst, e.Name...)
+		dst = append(dst, ": "...)
+	}
+	dst = append(dst, e.Message...)
+	dst = append(dst, formatFields(e.Fields)...)
+	if f.Color {
+		dst = append(dst, levelColorSuffix()...)
+	}
+	return append(dst, '\n')
+}
+
+// appendHeader appends the date, time and caller selected by e.Flags.
+func appendHeader(dst []byte, e *Entry) []byte {
+	t := e.Time
+	if e.Flags&log.LUTC != 0 {
+		t = t.UTC()
+	}
+	if e.Flags&log.Ldate != 0 {
+		dst = t.AppendFormat(dst, "2006/01/02 ")
+	}
+	if e.Flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		if e.Flags&log.Lmicroseconds != 0 {
+			dst = t.AppendFormat(dst, "15:04:05.000000 ")
+		} else {
+			dst = t.AppendFormat(dst, "15:04:05 ")
+		}
+	}
+	if e.Flags&(log.Lshortfile|log.Llongfile) != 0 {
+		dst = append(dst, caller(e)...)
+		dst = append(dst, ": "...)
+	}
+	return dst
+}
+
+// caller returns "file:line", with the file shortened to its base name
+// unless Llongfile is set.
+func caller(e *Entry) string {
+	if e.File == "" {
+		return "???:0"
+	}
+	file := e.File
+	if e.Flags&log.Llongfile == 0 {
+		for i := len(file) - 1; i > 0; i-- {
+			if file[i] == '/' {
+				file = file[i+1:]
+				break
+			}
+		}
+	}
+	return file + ":" + strconv.Itoa(e.Line)
+}
+
+// JSONFormatter renders every entry as one JSON object per line, with the
+// keys "time", "level", "logger" for named loggers, "caller" and "msg",
+// followed by the fields. Fields named like one of these keys get a
+// "fields." prefix.
+type JSONFormatter struct{}
+
+func (f *JSONFormatter) Format(dst []byte, e *Entry) []byte {
+	t := e.Time
+	if e.Flags&log.LUTC != 0 {
+		t = t.UTC()
+	}
+	dst = append(dst, `{"time":"`...)
+	dst = t.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, `","level":`...)
+	dst = appendJSON(dst, LevelName(e.Level))
+	if e.Name != "" {
+		dst = append(dst, `,"logger":`...)
+		dst = appendJSON(dst, e.Name)
+	}
+	dst = append(dst, `,"caller":`...)
+	dst = appendJSON(dst, caller(e))
+	dst = append(dst, `,"msg":`...)
+	dst = appendJSON(dst, e.Message)
+	for _, field := range e.Fields {
+		key := field.Key
+		switch key {
+		case "time", "level", "logger", "caller", "msg":
+			key = "fields." + key
+		}
+		dst = append(dst, ',')
+		dst = appendJSON(dst, key)
+		dst = append(dst, ':')
+		dst = appendJSON(dst, field.Value)
+	}
+	return append(dst, "}\n"...)
+}
+
+// appendJSON appends v as JSON. Errors become their message, and values
+// that cannot be marshaled are printed as strings.
+func appendJSON(dst []byte, v interface{}) []byte {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(dst, b...)
+}
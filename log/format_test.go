@@ -0,0 +1,98 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTextFormatter(t *testing.T) {
+	at := time.Date(2020, 3, 12, 9, 8, 7, 654321000, time.FixedZone("X", 3600))
+	entry := func(flags int, prefix string) *Entry {
+		return &Entry{
+			Time:    at,
+			Level:   LevelWarning,
+			File:    "/src/game/room.go",
+			Line:    42,
+			Message: "full",
+			Fields:  []Field{F("players", 8)},
+			Prefix:  prefix,
+			Flags:   flags,
+		}
+	}
+	tests := []struct {
+		e     *Entry
+		color bool
+		want  string
+	}{
+		{entry(0, ""), false, "[W]: full players=8\n"},
+		{entry(log.Ldate|log.Ltime, ""), false, "2020/03/12 09:08:07 [W]: full players=8\n"},
+		{entry(log.Ltime|log.Lmicroseconds|log.LUTC, ""), false, "08:08:07.654321 [W]: full players=8\n"},
+		{entry(log.Lshortfile, ""), false, "room.go:42: [W]: full players=8\n"},
+		{entry(log.Llongfile, ""), false, "/src/game/room.go:42: [W]: full players=8\n"},
+		{entry(log.Ltime|log.Lshortfile, "srv "), false, "srv 09:08:07 room.go:42: [W]: full players=8\n"},
+		{entry(log.Ltime|log.Lshortfile|log.Lmsgprefix, "srv "), false, "09:08:07 room.go:42: srv [W]: full players=8\n"},
+		{entry(0, ""), true, "\033[1;33m[W]: full players=8\033[0m\n"},
+		{&Entry{Level: LevelInfo, Name: "net", Message: "up", Flags: log.Lshortfile}, false, "???:0: [I]: net: up\n"},
+	}
+	for _, tt := range tests {
+		f := &TextFormatter{Color: tt.color}
+		if got := string(f.Format(nil, tt.e)); got != tt.want {
+			t.Errorf("flags %#x, prefix %q, color %v: got %q, want %q", tt.e.Flags, tt.e.Prefix, tt.color, got, tt.want)
+		}
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	e := &Entry{
+		Time:    time.Date(2020, 3, 12, 9, 8, 7, 0, time.UTC),
+		Level:   LevelError,
+		Name:    "net",
+		File:    "/src/game/room.go",
+		Line:    42,
+		Message: "lost",
+		Fields: []Field{
+			F("msg", "shadowed"),
+			F("time", 1),
+			F("err", errors.New("reset")),
+			F("inf", math.Inf(1)),
+		},
+	}
+	got := (&JSONFormatter{}).Format(nil, e)
+	want := `{"time":"2020-03-12T09:08:07Z","level":"[E]","logger":"net","caller":"room.go:42","msg":"lost",` +
+		`"fields.msg":"shadowed","fields.time":1,"err":"reset","inf":"+Inf"}` + "\n"
+	if string(got) != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(got, &m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONCaller(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "", log.Lshortfile, LevelDebug)
+	l.SetFormatter(&JSONFormatter{})
+
+	at := func() string { at := line(); l.Infof("n=%d", 1); return at }()
+	at2 := func() string { at := line(); l.With("k", "v").Warning("w"); return at }()
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range []struct{ caller, level, msg string }{
+		{at, "[I]", "n=1"},
+		{at2, "[W]", "w"},
+	} {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m["caller"] != want.caller || m["level"] != want.level || m["msg"] != want.msg {
+			t.Errorf("got %v, want caller %s", m, want.caller)
+		}
+	}
+}
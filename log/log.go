@@ -13,6 +13,7 @@ import (
     "strconv"
     "strings"
     "sync"
+    "time"
 )
 
 const (
@@ -100,7 +101,7 @@ func NameLevel(name string) int {
 func levelColorPrefix(level int) string {
     p, ok := colorPrefix[level]
     if !ok {
-        log.Println("ERROR: levelColorPrefix not found, level=%v", level)
+        log.Printf("ERROR: levelColorPrefix not found, level=%v", level)
         return ""
     }
     return p
@@ -111,60 +112,112 @@ func levelColorSuffix() string {
 }
 
 type Logger struct {
-    mu     sync.Mutex
-    level  int
-    logger *log.Logger
-}
-
+    mu        sync.Mutex
+    level     int
+    sinks     []*sink
+    prefix    string
+    flag      int
+    formatter Formatter
+    async     *asyncQueue
+
+    // named loggers share the root's lock and outputs
+    root     *Logger
+    name     string
+    rules    []levelRule
+    children map[string]*Logger
+}
+
+// New returns a Logger writing to out with a TextFormatter, colored except
+// on windows. More outputs can be added with AddSink, or all of them
+// replaced with SetSinks to give each its own level.
 func New(out io.Writer, prefix string, flag, level int) *Logger {
     return &Logger{
-        level:  level,
-        logger: log.New(out, prefix, flag),
+        level:     level,
+        sinks:     []*sink{{Sink: Sink{Out: out}}},
+        prefix:    prefix,
+        flag:      flag,
+        formatter: &TextFormatter{Color: runtime.GOOS != "windows"},
     }
 }
 
+// SetOutput replaces all sinks of l with w.
+func (l *Logger) SetOutput(w io.Writer) {
+    l = l.base()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.sinks = []*sink{{Sink: Sink{Out: w}}}
+}
+
+func (l *Logger) Formatter() Formatter {
+    l = l.base()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.formatter
+}
+
+func (l *Logger) SetFormatter(f Formatter) {
+    l = l.base()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.formatter = f
+}
+
 func (l *Logger) Flags() int {
+    l = l.base()
     l.mu.Lock()
     defer l.mu.Unlock()
-    return l.logger.Flags()
+    return l.flag
 }
 
 func (l *Logger) SetFlags(flag int) {
+    l = l.base()
     l.mu.Lock()
     defer l.mu.Unlock()
-    l.logger.SetFlags(flag)
+    l.flag = flag
 }
 
 func (l *Logger) Prefix() string {
+    l = l.base()
     l.mu.Lock()
     defer l.mu.Unlock()
-    return l.logger.Prefix()
+    return l.prefix
 }
 
 func (l *Logger) SetPrefix(prefix string) {
+    l = l.base()
     l.mu.Lock()
     defer l.mu.Unlock()
-    l.logger.SetPrefix(prefix)
+    l.prefix = prefix
 }
 
 func (l *Logger) Level() int {
-    l.mu.Lock()
-    defer l.mu.Unlock()
+    r := l.base()
+    r.mu.Lock()
+    defer r.mu.Unlock()
     return l.level
 }
 
+// SetLevel sets the level of l. For a named logger it adds a rule for its
+// exact name, replacing an earlier one.
 func (l *Logger) SetLevel(level int) {
-    l.mu.Lock()
-    defer l.mu.Unlock()
-    l.level = level
+    r := l.base()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if l == r {
+        l.level = level
+    } else {
+        r.setRule(l.name, level)
+    }
+    r.applyLevels()
 }
 
 func (l *Logger) Err(level, calldepth int, err error) error {
     if err != nil {
-        l.mu.Lock()
-        defer l.mu.Unlock()
+        r := l.base()
+        r.mu.Lock()
+        defer r.mu.Unlock()
         if level >= l.level {
-            return l.logger.Output(calldepth, fmt.Sprintf("%s: %s", LevelName(level), err))
+            return l.write(level, calldepth+1, err.Error(), nil)
         }
     }
     return nil
@@ -189,6 +242,7 @@ func (l *Logger) ErrError(err error) {
 func (l *Logger) ErrPanic(err error) {
     if err != nil {
         l.Err(LevelPanic, 3, err)
+        l.Flush()
         panic(err)
     }
 }
@@ -196,33 +250,40 @@ func (l *Logger) ErrPanic(err error) {
 func (l *Logger) ErrFatal(err error) {
     if err != nil {
         l.Err(LevelFatal, 3, err)
-        os.Exit(1)
+        l.exit()
     }
 }
 
-//lkj add:
-func formatOutput(level int, v ...interface{}) string {
-    if runtime.GOOS == "windows" {
-        return fmt.Sprintf("%s: %s",
-            LevelName(level),
-            fmt.Sprint(v...),
-        )
-    } else {
-        return fmt.Sprintf("%s%s: %s%s",
-            levelColorPrefix(level),
-            LevelName(level),
-            fmt.Sprint(v...),
-            levelColorSuffix())
+// write formats one entry and writes it out through the root logger, whose
+// mu must be held. calldepth 1 is write itself, as for log.Logger.Output.
+func (l *Logger) write(level, calldepth int, msg string, fields []Field) error {
+    r := l.base()
+    e := Entry{
+        Time:    time.Now(),
+        Level:   level,
+        Name:    l.name,
+        Message: msg,
+        Fields:  fields,
+        Prefix:  r.prefix,
+        Flags:   r.flag,
+    }
+    var ok bool
+    if _, e.File, e.Line, ok = runtime.Caller(calldepth - 1); !ok {
+        e.File = ""
     }
+    if r.async != nil {
+        r.async.push(queued{e: e, sinks: r.sinks, formatter: r.formatter})
+        return nil
+    }
+    return writeSinks(r.sinks, r.formatter, &e)
 }
 
 func (l *Logger) Output(level, calldepth int, v ...interface{}) error {
-    l.mu.Lock()
-    defer l.mu.Unlock()
+    r := l.base()
+    r.mu.Lock()
+    defer r.mu.Unlock()
     if level >= l.level {
 
-        outString := formatOutput(level, v)
-
         //if runtime.GOOS == "windows"{
         //    h := colorLevelStart_win(level)
         //    defer colorLevelEnd_win(h)
@@ -230,9 +291,7 @@ func (l *Logger) Output(level, calldepth int, v ...interface{}) error {
         //       outString,
         //    )
         //} else {
-        return l.logger.Output(calldepth,
-            outString,
-        )
+        return l.write(level, calldepth+1, fmt.Sprint(interface{}(v)), nil)
         //}
     }
     return nil
@@ -240,31 +299,29 @@ func (l *Logger) Output(level, calldepth int, v ...interface{}) error {
 
 // todo: 2020/03/12 error 存入文档
 func (l *Logger) Outputf(level, calldepth int, format string, v ...interface{}) error {
-    l.mu.Lock()
-    defer l.mu.Unlock()
+    r := l.base()
+    r.mu.Lock()
+    defer r.mu.Unlock()
     if level >= l.level {
         //lkj modify:
         //		return l.logger.Output(calldepth, fmt.Sprintf("%s: %s", LevelName(level), fmt.Sprintf(format, v...)))
         //-->
-        return l.logger.Output(calldepth,
-            formatOutput(level, fmt.Sprintf(format, v...)),
-        )
+        return l.write(level, calldepth+1, fmt.Sprintf(format, v...), nil)
         //]]
     }
     return nil
 }
 
 func (l *Logger) Outputln(level, calldepth int, v ...interface{}) error {
-    l.mu.Lock()
-    defer l.mu.Unlock()
+    r := l.base()
+    r.mu.Lock()
+    defer r.mu.Unlock()
     if level >= l.level {
         s := fmt.Sprintln(v...)
         s = s[:len(s)-1]
         //		return l.logger.Output(calldepth, fmt.Sprintf("%s: %s", LevelName(level), s))
         //-->
-        return l.logger.Output(calldepth,
-            formatOutput(level, s),
-        )
+        return l.write(level, calldepth+1, s, nil)
         //]]
     }
     return nil
@@ -289,12 +346,13 @@ func (l *Logger) Error(v ...interface{}) {
 func (l *Logger) Panic(v ...interface{}) {
     s := fmt.Sprint(v...)
     l.Output(LevelPanic, 3, s)
+    l.Flush()
     panic(s)
 }
 
 func (l *Logger) Fatal(v ...interface{}) {
     l.Output(LevelFatal, 3, v...)
-    os.Exit(1)
+    l.exit()
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
@@ -316,12 +374,13 @@ func (l *Logger) Errorf(format string, v ...interface{}) {
 func (l *Logger) Panicf(format string, v ...interface{}) {
     s := fmt.Sprintf(format, v...)
     l.Outputf(LevelPanic, 3, "%s", s)
+    l.Flush()
     panic(s)
 }
 
 func (l *Logger) Fatalf(format string, v ...interface{}) {
     l.Outputf(LevelFatal, 3, format, v...)
-    os.Exit(1)
+    l.exit()
 }
 
 func (l *Logger) Debugln(v ...interface{}) {
@@ -344,19 +403,24 @@ func (l *Logger) Panicln(v ...interface{}) {
     s := fmt.Sprintln(v...)
     s = s[:len(s)-1]
     l.Outputln(LevelPanic, 3, s)
+    l.Flush()
     panic(s)
 }
 
 func (l *Logger) Fatalln(v ...interface{}) {
     l.Outputln(LevelFatal, 3, v...)
-    os.Exit(1)
+    l.exit()
 }
 
 //lkj: set level to DEBUG
 var std = New(os.Stderr, "", log.LstdFlags|log.Lshortfile, LevelDebug)
 
 func SetOutput(w io.Writer) {
-    *std = *New(w, std.logger.Prefix(), std.logger.Flags(), std.level)
+    std.SetOutput(w)
+}
+
+func SetFormatter(f Formatter) {
+    std.SetFormatter(f)
 }
 
 func Flags() int {
@@ -402,6 +466,7 @@ func ErrError(err error) {
 func ErrPanic(err error) {
     if err != nil {
         std.Err(LevelPanic, 3, err)
+        std.Flush()
         panic(err)
     }
 }
@@ -409,7 +474,7 @@ func ErrPanic(err error) {
 func ErrFatal(err error) {
     if err != nil {
         std.Err(LevelFatal, 3, err)
-        os.Exit(1)
+        std.exit()
     }
 }
 
@@ -451,12 +516,14 @@ func ErrorDepth(callDepth int, v ...interface{}) {
 func Panic(v ...interface{}) {
     s := fmt.Sprint(v...)
     std.Output(LevelPanic, 3, s)
+    std.Flush()
     panic(s)
 }
 
 func PanicDepth(callDepth int, v ...interface{}) {
     s := fmt.Sprint(v...)
     std.Output(LevelPanic, callDepth, s)
+    std.Flush()
     panic(s)
 }
 
@@ -464,12 +531,12 @@ func PanicDepth(callDepth int, v ...interface{}) {
 
 func Fatal(v ...interface{}) {
     std.Output(LevelFatal, 3, v...)
-    os.Exit(1)
+    std.exit()
 }
 
 func FatalDepth(calldepth int, v ...interface{}) {
     std.Output(LevelFatal, calldepth, v...)
-    os.Exit(1)
+    std.exit()
 }
 
 func Debugf(format string, v ...interface{}) {
@@ -507,23 +574,25 @@ func ErrorDepthf(calldepth int, format string, v ...interface{}) {
 func Panicf(format string, v ...interface{}) {
     s := fmt.Sprintf(format, v...)
     std.Outputf(LevelPanic, 3, "%s", s)
+    std.Flush()
     panic(s)
 }
 
 func PanicDepthf(calldepth int, format string, v ...interface{}) {
     s := fmt.Sprintf(format, v...)
     std.Outputf(LevelPanic, calldepth, "%s", s)
+    std.Flush()
     panic(s)
 }
 
 func Fatalf(format string, v ...interface{}) {
     std.Outputf(LevelFatal, 3, format, v...)
-    os.Exit(1)
+    std.exit()
 }
 
 func FatalDepthf(calldepth int, format string, v ...interface{}) {
     std.Outputf(LevelFatal, calldepth, format, v...)
-    os.Exit(1)
+    std.exit()
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -548,12 +617,13 @@ func Panicln(v ...interface{}) {
     s := fmt.Sprintln(v...)
     s = s[:len(s)-1]
     std.Outputln(LevelPanic, 3, s)
+    std.Flush()
     panic(s)
 }
 
 func Fatalln(v ...interface{}) {
     std.Outputln(LevelFatal, 3, v...)
-    os.Exit(1)
+    std.exit()
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////
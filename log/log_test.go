@@ -0,0 +1,114 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// newTestLogger returns a Logger writing uncolored lines with the caller's
+// file and line to buf.
+func newTestLogger(buf *bytes.Buffer) *Logger {
+	l := New(buf, "", log.Lshortfile, LevelDebug)
+	l.SetFormatter(&TextFormatter{})
+	return l
+}
+
+// line returns "file.go:n" for the line it is called on.
+func line() string {
+	_, file, n, _ := runtime.Caller(1)
+	return filepath.Base(file) + ":" + strconv.Itoa(n)
+}
+
+func TestOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf)
+	tests := []struct {
+		log  func() string
+		want string
+	}{
+		{func() string { at := line(); l.Info("a", "b"); return at }, ": [I]: [a b]\n"},
+		{func() string { at := line(); l.Infof("%s-%s", "a", "b"); return at }, ": [I]: a-b\n"},
+		{func() string { at := line(); l.Infoln("a", "b"); return at }, ": [I]: a b\n"},
+		{func() string { at := line(); l.ErrWarning(errors.New("oops")); return at }, ": [W]: oops\n"},
+		{func() string { at := line(); l.With("k", 1).Error("msg", "n", "x y"); return at }, `: [E]: msg k=1 n="x y"` + "\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		at := tt.log()
+		if got, want := buf.String(), at+tt.want; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	buf.Reset()
+	l.SetLevel(LevelInfo)
+	l.Debug("hidden")
+	l.With("k", 1).Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug entry written below the level: %q", buf.String())
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf)
+	l.SetFlags(0)
+	base := l.With("user", "ann", F("id", 7))
+	child := base.With("room", "lobby")
+	tests := []struct {
+		c    *Context
+		kv   []interface{}
+		want string
+	}{
+		{base, nil, "[I]: hello user=ann id=7\n"},
+		{child, nil, "[I]: hello user=ann id=7 room=lobby\n"},
+		{base, []interface{}{"empty", ""}, `[I]: hello user=ann id=7 empty=""` + "\n"},
+		{base, []interface{}{"q", `a"b`, "eq", "a=b"}, `[I]: hello user=ann id=7 q="a\"b" eq="a=b"` + "\n"},
+		{base, []interface{}{"dangling"}, "[I]: hello user=ann id=7 !BADKEY=dangling\n"},
+		{base, []interface{}{42, "x", 1}, "[I]: hello user=ann id=7 !BADKEY=42 x=1\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		tt.c.Info("hello", tt.kv...)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+
+	// a child's fields do not leak into its parent
+	buf.Reset()
+	base.With("a", 1)
+	base.With("b", 2).Info("hello")
+	if got, want := buf.String(), "[I]: hello user=ann id=7 b=2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCallerDepth(t *testing.T) {
+	var buf bytes.Buffer
+	old := std
+	std = newTestLogger(&buf)
+	defer func() { std = old }()
+
+	helper := func() { InfoDepth(4, "from helper") }
+	for _, log := range []func() string{
+		func() string { at := line(); Info("x"); return at },
+		func() string { at := line(); Infof("x"); return at },
+		func() string { at := line(); Infoln("x"); return at },
+		func() string { at := line(); ErrError(errors.New("x")); return at },
+		func() string { at := line(); With().Info("x"); return at },
+		func() string { at := line(); Named("child").Info("x"); return at },
+		func() string { at := line(); helper(); return at },
+	} {
+		buf.Reset()
+		at := log()
+		if !bytes.HasPrefix(buf.Bytes(), []byte(at+": ")) {
+			t.Errorf("got %q, want caller %s", buf.String(), at)
+		}
+	}
+}
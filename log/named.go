@@ -0,0 +1,163 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// levelRule sets the level of the named loggers matching pattern.
+type levelRule struct {
+	pattern string
+	level   int
+}
+
+// Named returns the child logger called name, or parent.name for a child of
+// a child. It writes through l's sinks, formatter and async queue, but has
+// its own level: that of the last rule set by SetLevels matching its name,
+// or l's level. The same name always returns the same logger.
+func (l *Logger) Named(name string) *Logger {
+	if l.name != "" {
+		name = l.name + "." + name
+	}
+	r := l.base()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.children[name]; ok {
+		return c
+	}
+	c := &Logger{root: r, name: name, level: r.levelFor(name)}
+	if r.children == nil {
+		r.children = make(map[string]*Logger)
+	}
+	r.children[name] = c
+	return c
+}
+
+// Name returns the name of a logger returned by Named, or "".
+func (l *Logger) Name() string {
+	return l.name
+}
+
+// SetLevels replaces the level rules of l's named loggers with spec, a
+// comma separated list of pattern=level such as "net.*=warning,combat=debug".
+// Patterns are matched as by path.Match and later rules win. Levels are
+// names like "debug", LevelName names like "[D]", or numbers. It can be
+// called at any time; the new levels apply to the next entry.
+func (l *Logger) SetLevels(spec string) error {
+	var rules []levelRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndexByte(item, '=')
+		if i < 0 {
+			return fmt.Errorf("log: level rule %q is not pattern=level", item)
+		}
+		pattern := strings.TrimSpace(item[:i])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("log: level rule %q: %v", item, err)
+		}
+		level, err := parseLevel(strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return err
+		}
+		rules = append(rules, levelRule{pattern: pattern, level: level})
+	}
+
+	r := l.base()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+	r.applyLevels()
+	return nil
+}
+
+// SetLevelsFromEnv calls SetLevels with the environment variable key, if
+// it is set.
+func (l *Logger) SetLevelsFromEnv(key string) error {
+	spec, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	return l.SetLevels(spec)
+}
+
+// Named returns a child of the standard logger.
+func Named(name string) *Logger {
+	return std.Named(name)
+}
+
+func SetLevels(spec string) error {
+	return std.SetLevels(spec)
+}
+
+func SetLevelsFromEnv(key string) error {
+	return std.SetLevelsFromEnv(key)
+}
+
+// base returns the root logger, which holds the outputs and the lock.
+func (l *Logger) base() *Logger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// setRule adds or replaces the rule for pattern; l must be a root logger
+// with l.mu held.
+func (l *Logger) setRule(pattern string, level int) {
+	for i := range l.rules {
+		if l.rules[i].pattern == pattern {
+			l.rules[i].level = level
+			return
+		}
+	}
+	l.rules = append(l.rules, levelRule{pattern: pattern, level: level})
+}
+
+// levelFor returns the level of the child called name; l must be a root
+// logger with l.mu held.
+func (l *Logger) levelFor(name string) int {
+	level := l.level
+	for _, rule := range l.rules {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			level = rule.level
+		}
+	}
+	return level
+}
+
+// applyLevels updates the levels of all children; l must be a root logger
+// with l.mu held.
+func (l *Logger) applyLevels() {
+	for name, c := range l.children {
+		c.level = l.levelFor(name)
+	}
+}
+
+var levelNames = map[string]int{
+	"debug":   LevelDebug,
+	"info":    LevelInfo,
+	"warn":    LevelWarning,
+	"warning": LevelWarning,
+	"error":   LevelError,
+	"panic":   LevelPanic,
+	"fatal":   LevelFatal,
+}
+
+func parseLevel(s string) (int, error) {
+	if level, ok := levelNames[strings.ToLower(s)]; ok {
+		return level, nil
+	}
+	if level := NameLevel(s); level != 0 {
+		return level, nil
+	}
+	if level, err := strconv.Atoi(s); err == nil {
+		return level, nil
+	}
+	return 0, fmt.Errorf("log: unknown level %q", s)
+}
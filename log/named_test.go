@@ -0,0 +1,118 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNamed(t *testing.T) {
+	l := New(&bytes.Buffer{}, "", 0, LevelInfo)
+	net := l.Named("net")
+	if l.Named("net") != net {
+		t.Fatal("Named returned a new logger for the same name")
+	}
+	tcp := net.Named("tcp")
+	if tcp.Name() != "net.tcp" || l.Named("net.tcp") != tcp || l.Name() != "" {
+		t.Fatalf("got name %q", tcp.Name())
+	}
+	if tcp.Level() != LevelInfo {
+		t.Fatalf("child level %d, want the parent's %d", tcp.Level(), LevelInfo)
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]int // level by logger name; "" is the root
+		err  bool
+	}{
+		{"", map[string]int{"": LevelInfo, "net": LevelInfo, "net.tcp": LevelInfo}, false},
+		{"net=debug", map[string]int{"": LevelInfo, "net": LevelDebug, "net.tcp": LevelInfo}, false},
+		{"net.*=warn, combat=[E]", map[string]int{"net": LevelInfo, "net.tcp": LevelWarning, "combat": LevelError}, false},
+		{"*=error,net.tcp=debug", map[string]int{"net": LevelError, "net.tcp": LevelDebug}, false},
+		{"net.tcp=debug,*=error", map[string]int{"net": LevelError, "net.tcp": LevelError}, false},
+		{"net=25,", map[string]int{"net": 25}, false},
+		{"net", nil, true},
+		{"net=loud", nil, true},
+		{"[=debug", nil, true},
+	}
+	for _, tt := range tests {
+		l := New(&bytes.Buffer{}, "", 0, LevelInfo)
+		for _, name := range []string{"net", "net.tcp", "combat"} {
+			l.Named(name)
+		}
+		err := l.SetLevels(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		for name, want := range tt.want {
+			c := l
+			if name != "" {
+				c = l.Named(name)
+			}
+			if got := c.Level(); got != want {
+				t.Errorf("%q: %q has level %d, want %d", tt.spec, name, got, want)
+			}
+		}
+	}
+}
+
+func TestSetLevelsRuntime(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "", 0, LevelInfo)
+	l.SetFormatter(&TextFormatter{})
+	net := l.Named("net")
+
+	net.Debugf("hidden")
+	if err := l.SetLevels("net=debug"); err != nil {
+		t.Fatal(err)
+	}
+	net.Debugf("shown")
+	if got, want := buf.String(), "[D]: net: shown\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// a rejected spec keeps the current levels
+	if err := l.SetLevels("net=loud"); err == nil || net.Level() != LevelDebug {
+		t.Fatalf("got %v and level %d", err, net.Level())
+	}
+
+	// a child's SetLevel is a rule for its name, replaced by SetLevels
+	net.SetLevel(LevelError)
+	if net.Level() != LevelError {
+		t.Fatalf("got level %d, want %d", net.Level(), LevelError)
+	}
+	if l.Named("net.tcp").Level() != LevelInfo {
+		t.Fatal("SetLevel on a child changed a grandchild")
+	}
+	if err := l.SetLevels("combat=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if net.Level() != LevelInfo {
+		t.Fatalf("got level %d after SetLevels, want the root's %d", net.Level(), LevelInfo)
+	}
+
+	// children without a rule follow the root
+	l.SetLevel(LevelWarning)
+	if net.Level() != LevelWarning || l.Named("combat").Level() != LevelDebug {
+		t.Fatalf("got levels %d and %d", net.Level(), l.Named("combat").Level())
+	}
+}
+
+func TestSetLevelsFromEnv(t *testing.T) {
+	l := New(&bytes.Buffer{}, "", 0, LevelInfo)
+	net := l.Named("net")
+
+	t.Setenv("TEST_LOG_LEVELS", "net=debug")
+	if err := l.SetLevelsFromEnv("TEST_LOG_LEVELS"); err != nil || net.Level() != LevelDebug {
+		t.Fatalf("got %v and level %d", err, net.Level())
+	}
+	if err := l.SetLevelsFromEnv("TEST_LOG_LEVELS_UNSET"); err != nil || net.Level() != LevelDebug {
+		t.Fatalf("unset variable: got %v and level %d", err, net.Level())
+	}
+	t.Setenv("TEST_LOG_LEVELS", "net")
+	if err := l.SetLevelsFromEnv("TEST_LOG_LEVELS"); err == nil {
+		t.Fatal("bad spec accepted")
+	}
+}
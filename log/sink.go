@@ -0,0 +1,77 @@
+package log
+
+import "io"
+
+// Sink is one output of a Logger. Every entry that passes the Logger's
+// level goes to each sink whose Level it reaches.
+type Sink struct {
+	Out       io.Writer
+	Level     int       // minimum level written to Out
+	Formatter Formatter // nil means the Logger's formatter
+}
+
+type sink struct {
+	Sink
+	buf []byte
+}
+
+// AddSink makes l also write to s.
+func (l *Logger) AddSink(s Sink) {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, &sink{Sink: s})
+}
+
+// SetSinks replaces all outputs of l with sinks.
+func (l *Logger) SetSinks(sinks ...Sink) {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = make([]*sink, len(sinks))
+	for i, s := range sinks {
+		l.sinks[i] = &sink{Sink: s}
+	}
+}
+
+// Sinks returns the outputs of l.
+func (l *Logger) Sinks() []Sink {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sinks := make([]Sink, len(l.sinks))
+	for i, s := range l.sinks {
+		sinks[i] = s.Sink
+	}
+	return sinks
+}
+
+// AddSink makes the standard logger also write to s.
+func AddSink(s Sink) {
+	std.AddSink(s)
+}
+
+// SetSinks replaces all outputs of the standard logger with sinks.
+func SetSinks(sinks ...Sink) {
+	std.SetSinks(sinks...)
+}
+
+// writeSinks writes e to every sink it reaches, using formatter where a
+// sink has none, and returns the first error.
+func writeSinks(sinks []*sink, formatter Formatter, e *Entry) error {
+	var first error
+	for _, s := range sinks {
+		if e.Level < s.Level {
+			continue
+		}
+		f := s.Formatter
+		if f == nil {
+			f = formatter
+		}
+		s.buf = f.Format(s.buf[:0], e)
+		if _, err := s.Out.Write(s.buf); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	var errs, debug, all bytes.Buffer
+	l := New(&all, "", 0, LevelDebug)
+	l.SetFormatter(&TextFormatter{})
+	l.SetSinks(
+		Sink{Out: &errs, Level: LevelError},
+		Sink{Out: &debug, Level: LevelDebug, Formatter: &JSONFormatter{}},
+	)
+	if n := len(l.Sinks()); n != 2 {
+		t.Fatalf("%d sinks, want 2", n)
+	}
+
+	l.Errorf("disk %s", "full")
+	l.Debugf("tick %d", 1)
+	if got, want := errs.String(), "[E]: disk full\n"; got != want {
+		t.Errorf("error sink: got %q, want %q", got, want)
+	}
+	if got := debug.String(); strings.Count(got, "\n") != 2 ||
+		!strings.Contains(got, `"msg":"disk full"`) || !strings.Contains(got, `"msg":"tick 1"`) {
+		t.Errorf("debug sink: got %q", got)
+	}
+	if all.Len() != 0 {
+		t.Errorf("replaced output still written: %q", all.String())
+	}
+
+	// the Logger's level applies before the sinks' levels
+	debug.Reset()
+	l.SetLevel(LevelInfo)
+	l.Debugf("tick %d", 2)
+	if debug.Len() != 0 {
+		t.Errorf("debug entry written below the Logger's level: %q", debug.String())
+	}
+
+	l.SetSinks()
+	l.Errorf("nowhere")
+	if errs.Len() != len("[E]: disk full\n") {
+		t.Errorf("entry written after removing all sinks: %q", errs.String())
+	}
+}
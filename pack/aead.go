@@ -0,0 +1,146 @@
+package pack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// FlagEncrypted marks a frame whose payload was sealed by an AEAD.
+const FlagEncrypted uint16 = 1 << 14
+
+// replayWindow is how many sequence numbers behind the newest one a frame
+// may arrive and still be accepted.
+const replayWindow = 64
+
+var (
+	// ErrDecrypt reports a frame that is not encrypted or fails authentication.
+	ErrDecrypt = errors.New("pack: frame authentication failed")
+	// ErrReplay reports a frame whose sequence number was already accepted
+	// or is too old to tell.
+	ErrReplay = errors.New("pack: replayed frame")
+	// ErrSeqExhausted reports that a session sent all 2^32 sequence numbers
+	// and must be rekeyed.
+	ErrSeqExhausted = errors.New("pack: sequence numbers exhausted")
+)
+
+// AEAD seals frame payloads for one end of a session. The nonce of every
+// frame is derived from its sequence number and the sending side, so both
+// ends may share one key.
+type AEAD struct {
+	aead   cipher.AEAD
+	server bool
+
+	sendMu  sync.Mutex
+	sendSeq uint64
+
+	recvMu  sync.Mutex
+	recvMax uint32 // newest sequence number accepted
+	recvAny bool
+	recvWin uint64 // bit i set: recvMax-i was accepted
+}
+
+// NewAEAD wraps aead, e.g. AES-GCM or chacha20poly1305.New from
+// golang.org/x/crypto. server tells the two ends of a session apart.
+func NewAEAD(aead cipher.AEAD, server bool) *AEAD {
+	if aead.NonceSize() < 5 {
+		panic("pack: AEAD nonce too short")
+	}
+	return &AEAD{aead: aead, server: server}
+}
+
+// NewAESGCM returns an AEAD using AES-GCM with a 16, 24 or 32 byte key.
+func NewAESGCM(key []byte, server bool) (*AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return NewAEAD(gcm, server), nil
+}
+
+// Seal encrypts the payload of f, assigning it the next sequence number of
+// the session and setting FlagEncrypted. The header is authenticated too.
+func (a *AEAD) Seal(f Frame) (Frame, error) {
+	a.sendMu.Lock()
+	if a.sendSeq > 0xffffffff {
+		a.sendMu.Unlock()
+		return Frame{}, ErrSeqExhausted
+	}
+	f.Seq = uint32(a.sendSeq)
+	a.sendSeq++
+	a.sendMu.Unlock()
+
+	f.Flags |= FlagEncrypted
+	f.Payload = a.aead.Seal(nil, a.nonce(f.Seq, a.server), f.Payload, additionalData(f))
+	return f, nil
+}
+
+// Open decrypts a frame sealed by the other end of the session, rejecting
+// forged, tampered and replayed frames. Frames may arrive out of order by up
+// to 64 sequence numbers.
+func (a *AEAD) Open(f Frame) (Frame, error) {
+	if f.Flags&FlagEncrypted == 0 {
+		return Frame{}, ErrDecrypt
+	}
+
+	a.recvMu.Lock()
+	defer a.recvMu.Unlock()
+	if a.replayed(f.Seq) {
+		return Frame{}, ErrReplay
+	}
+	payload, err := a.aead.Open(nil, a.nonce(f.Seq, !a.server), f.Payload, additionalData(f))
+	if err != nil {
+		return Frame{}, ErrDecrypt
+	}
+	a.accept(f.Seq)
+
+	f.Flags &^= FlagEncrypted
+	f.Payload = payload
+	return f, nil
+}
+
+func (a *AEAD) nonce(seq uint32, server bool) []byte {
+	nonce := make([]byte, a.aead.NonceSize())
+	if server {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], seq)
+	return nonce
+}
+
+func (a *AEAD) replayed(seq uint32) bool {
+	if !a.recvAny || seq > a.recvMax {
+		return false
+	}
+	d := a.recvMax - seq
+	return d >= replayWindow || a.recvWin&(1<<d) != 0
+}
+
+func (a *AEAD) accept(seq uint32) {
+	if !a.recvAny {
+		a.recvAny = true
+		a.recvMax = seq
+		a.recvWin = 1
+		return
+	}
+	if seq > a.recvMax {
+		if d := seq - a.recvMax; d < replayWindow {
+			a.recvWin = a.recvWin<<d | 1
+		} else {
+			a.recvWin = 1
+		}
+		a.recvMax = seq
+		return
+	}
+	a.recvWin |= 1 << (a.recvMax - seq)
+}
+
+func additionalData(f Frame) []byte {
+	return appendFrameHeader(make([]byte, 0, FrameHeaderLength), f)
+}
@@ -0,0 +1,132 @@
+package pack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newAEADPair(t *testing.T) (client, server *AEAD) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewAESGCM(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ = NewAESGCM(key, true)
+	return client, server
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	client, server := newAEADPair(t)
+
+	var stream []byte
+	for _, m := range []string{"login", "", "move"} {
+		f, err := client.Seal(Frame{Type: 3, Payload: []byte(m)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != "" && bytes.Contains(f.Payload, []byte(m)) {
+			t.Fatalf("payload %q not encrypted", m)
+		}
+		stream = append(stream, PackFrame(f)...)
+	}
+
+	d := NewDecoder(bytes.NewReader(stream))
+	for i, want := range []string{"login", "", "move"} {
+		f, err := d.NextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err = server.Open(f)
+		if err != nil || f.Type != 3 || f.Flags != 0 || f.Seq != uint32(i) || string(f.Payload) != want {
+			t.Fatalf("got %+v, %v, want %q", f, err, want)
+		}
+	}
+
+	f, _ := server.Seal(Frame{Type: 4, Payload: []byte("welcome")})
+	if f, err := client.Open(f); err != nil || string(f.Payload) != "welcome" {
+		t.Fatalf("server to client: got %q, %v", f.Payload, err)
+	}
+}
+
+func TestAEADTamper(t *testing.T) {
+	client, server := newAEADPair(t)
+
+	f, _ := client.Seal(Frame{Type: 3, Payload: []byte("gold=100")})
+	tampered := f
+	tampered.Payload = append([]byte(nil), f.Payload...)
+	tampered.Payload[0] ^= 1
+	if _, err := server.Open(tampered); err != ErrDecrypt {
+		t.Fatalf("tampered payload: got %v, want ErrDecrypt", err)
+	}
+	retyped := f
+	retyped.Type = 4
+	if _, err := server.Open(retyped); err != ErrDecrypt {
+		t.Fatalf("tampered header: got %v, want ErrDecrypt", err)
+	}
+	if _, err := client.Open(f); err != ErrDecrypt {
+		t.Fatalf("reflected frame: got %v, want ErrDecrypt", err)
+	}
+	if _, err := server.Open(Frame{Type: 3, Payload: []byte("plain")}); err != ErrDecrypt {
+		t.Fatalf("plain frame: got %v, want ErrDecrypt", err)
+	}
+	if _, err := server.Open(f); err != nil {
+		t.Fatalf("original frame: %v", err)
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	client, server := newAEADPair(t)
+
+	var frames []Frame
+	for i := 0; i < 100; i++ {
+		f, _ := client.Seal(Frame{Payload: []byte{byte(i)}})
+		frames = append(frames, f)
+	}
+
+	for _, i := range []int{1, 0, 70, 50} {
+		if _, err := server.Open(frames[i]); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{1, 70, 50, 5} {
+		if _, err := server.Open(frames[i]); err != ErrReplay {
+			t.Fatalf("frame %d: got %v, want ErrReplay", i, err)
+		}
+	}
+	if _, err := server.Open(frames[69]); err != nil {
+		t.Fatalf("late frame within window: %v", err)
+	}
+}
+
+func TestAEADSeqExhausted(t *testing.T) {
+	client, _ := newAEADPair(t)
+	client.sendSeq = 1 << 32
+	c := &Codec{Magic: []byte{0xfe}, LengthSize: 2, AEAD: client}
+
+	if b, err := c.EncodeFrame([]byte("x"), Frame{Type: 1}); err != ErrSeqExhausted || string(b) != "x" {
+		t.Fatalf("EncodeFrame: got %q, %v", b, err)
+	}
+	r := c.NewRegistry()
+	if err := r.Register(1, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Encode("hi"); err != ErrSeqExhausted {
+		t.Fatalf("Encode: got %v, want ErrSeqExhausted", err)
+	}
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	ka := NewKeepalive(c.NewConn(cli), time.Hour, time.Hour)
+	defer ka.Close()
+	if err := ka.WriteFrame(Frame{Type: 1}); err != ErrSeqExhausted {
+		t.Fatalf("Keepalive.WriteFrame: got %v, want ErrSeqExhausted", err)
+	}
+
+	defer func() {
+		if r := recover(); r != ErrSeqExhausted {
+			t.Fatalf("AppendFrame: got panic %v, want ErrSeqExhausted", r)
+		}
+	}()
+	c.AppendFrame(nil, Frame{Type: 1})
+}
@@ -0,0 +1,222 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureVersion is the capture file format version written by CaptureWriter.
+const CaptureVersion = 1
+
+const (
+	captureMagic        = "PKCAP"
+	captureHeaderLength = 8 // magic, version, two reserved bytes
+	recordHeaderLength  = 9 // unix nanoseconds, direction
+)
+
+// captureCodec frames capture records. The checksum lets a reader stop
+// cleanly at a torn record left by a crash.
+var captureCodec = &Codec{
+	Magic:          []byte{0xca, 0x97},
+	LengthSize:     4,
+	MaxFrameLength: -1,
+	CRC32:          crc32.IEEETable,
+}
+
+// ErrBadCapture reports a file that is not a capture or has an unknown version.
+var ErrBadCapture = errors.New("pack: not a capture file")
+
+// Direction tells whether a captured frame was received or sent.
+type Direction uint8
+
+const (
+	DirIn Direction = iota + 1
+	DirOut
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirIn:
+		return "in"
+	case DirOut:
+		return "out"
+	}
+	return "unknown"
+}
+
+// Record is one captured frame.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Data      []byte
+}
+
+// CaptureWriter appends records to a capture.
+type CaptureWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewCaptureWriter writes a capture file header to w and returns a writer
+// for the records that follow.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(captureHeader()); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// CreateCapture opens the capture file name for appending, creating it if
+// needed. An existing file must be a capture of the current version.
+func CreateCapture(name string) (*CaptureWriter, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		_, err = f.Write(captureHeader())
+	} else {
+		err = readCaptureHeader(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &CaptureWriter{w: f}, nil
+}
+
+// Write appends a record for data with the current time. Each record goes
+// out in a single Write, so concurrent appends to a file do not interleave.
+func (cw *CaptureWriter) Write(dir Direction, data []byte) error {
+	return cw.WriteRecord(Record{Time: time.Now(), Direction: dir, Data: data})
+}
+
+// WriteRecord appends r.
+func (cw *CaptureWriter) WriteRecord(r Record) error {
+	body := make([]byte, recordHeaderLength, recordHeaderLength+len(r.Data))
+	binary.BigEndian.PutUint64(body, uint64(r.Time.UnixNano()))
+	body[8] = byte(r.Direction)
+	body = append(body, r.Data...)
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	_, err := cw.w.Write(captureCodec.Pack(body))
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (cw *CaptureWriter) Close() error {
+	if c, ok := cw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CaptureReader reads records from a capture.
+type CaptureReader struct {
+	dec *Decoder
+}
+
+// NewCaptureReader checks the capture file header at the start of r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	if err := readCaptureHeader(r); err != nil {
+		return nil, err
+	}
+	return &CaptureReader{dec: captureCodec.NewDecoder(r)}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+// Corrupted and truncated records are skipped, including a record torn by
+// a crash that later appends were written behind.
+func (cr *CaptureReader) Next() (Record, error) {
+	for {
+		body, err := cr.dec.Next()
+		if err == io.ErrUnexpectedEOF {
+			// the reader is exhausted, so look for records behind the
+			// torn one in what is left in the buffer
+			if cr.dec.skip() {
+				continue
+			}
+			return Record{}, io.EOF
+		}
+		if err == ErrChecksum || err == ErrBadLength {
+			continue
+		}
+		if err != nil {
+			return Record{}, err
+		}
+		if len(body) < recordHeaderLength {
+			continue
+		}
+		return Record{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(body))),
+			Direction: Direction(body[8]),
+			Data:      append([]byte{}, body[recordHeaderLength:]...),
+		}, nil
+	}
+}
+
+// Stats returns the counters of the underlying Decoder, which tell how
+// much of the capture was skipped as damaged.
+func (cr *CaptureReader) Stats() Stats {
+	return cr.dec.Stats()
+}
+
+// Replay calls fn for every remaining record, spaced as they were captured
+// and sped up by speed. A speed of zero replays as fast as possible.
+func (cr *CaptureReader) Replay(speed float64, fn func(Record) error) error {
+	var start, first time.Time
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				start, first = time.Now(), r.Time
+			}
+			due := start.Add(time.Duration(float64(r.Time.Sub(first)) / speed))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+func captureHeader() []byte {
+	h := make([]byte, captureHeaderLength)
+	copy(h, captureMagic)
+	h[len(captureMagic)] = CaptureVersion
+	return h
+}
+
+func readCaptureHeader(r io.Reader) error {
+	h := make([]byte, captureHeaderLength)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrBadCapture
+		}
+		return err
+	}
+	if string(h[:len(captureMagic)]) != captureMagic || h[len(captureMagic)] != CaptureVersion {
+		return ErrBadCapture
+	}
+	return nil
+}
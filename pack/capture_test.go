@@ -0,0 +1,149 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "session.pcap")
+	for _, data := range []string{"login", "welcome"} {
+		// reopen every time to check appending keeps one header
+		cw, err := CreateCapture(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := DirIn
+		if data == "welcome" {
+			dir = DirOut
+		}
+		if err := cw.Write(dir, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+	}
+
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a torn record at the tail, as left by a crash mid-write
+	torn := captureCodec.Pack(make([]byte, 20))
+	raw = append(raw, torn[:len(torn)-3]...)
+
+	cr, err := NewCaptureReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Record
+	if err := cr.Replay(0, func(r Record) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[0].Data) != "login" || got[0].Direction != DirIn ||
+		string(got[1].Data) != "welcome" || got[1].Direction != DirOut || got[1].Time.Before(got[0].Time) {
+		t.Fatalf("got %+v", got)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture"))); err != ErrBadCapture {
+		t.Fatalf("got %v, want ErrBadCapture", err)
+	}
+}
+
+func TestCaptureAppendAfterTornTail(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "session.pcap")
+	cw, err := CreateCapture(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Write(DirIn, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	cw.Close()
+
+	// crash in the middle of a large record
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := captureCodec.Pack(make([]byte, 1000))
+	if _, err := f.Write(torn[:100]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// restart and keep appending
+	cw, err = CreateCapture(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := cw.Write(DirOut, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cw.Close()
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cr, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Record
+	if err := cr.Replay(0, func(r Record) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 || string(got[0].Data) != "before" {
+		t.Fatalf("got %d records, want 6", len(got))
+	}
+	for i, r := range got[1:] {
+		if r.Direction != DirOut || len(r.Data) != 1 || r.Data[0] != byte(i) {
+			t.Fatalf("record %d: got %+v", i+1, r)
+		}
+	}
+	if s := cr.Stats(); s.Skipped != 100 {
+		t.Fatalf("skipped %d bytes, want 100", s.Skipped)
+	}
+}
+
+func TestCaptureReplaySpeed(t *testing.T) {
+	var buf bytes.Buffer
+	cw, _ := NewCaptureWriter(&buf)
+	start := time.Now()
+	cw.WriteRecord(Record{Time: start, Direction: DirIn, Data: []byte("a")})
+	cw.WriteRecord(Record{Time: start.Add(100 * time.Millisecond), Direction: DirIn, Data: []byte("b")})
+
+	// a corrupted record in the middle is skipped
+	data := buf.Bytes()
+	bad := captureCodec.Pack([]byte("corrupted record"))
+	bad[len(bad)-1] ^= 0xff
+	data = append(data, bad...)
+	data = append(data, captureCodec.Pack(make([]byte, recordHeaderLength))...)
+
+	cr, _ := NewCaptureReader(bytes.NewReader(data))
+	began := time.Now()
+	n := 0
+	cr.Replay(4, func(Record) error {
+		n++
+		return nil
+	})
+	if elapsed := time.Since(began); n != 3 || elapsed < 20*time.Millisecond || elapsed > 90*time.Millisecond {
+		t.Fatalf("replayed %d records in %v", n, elapsed)
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
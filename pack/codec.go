@@ -0,0 +1,321 @@
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"sync"
+)
+
+const (
+	// LengthUvarint selects a uvarint encoded length field in Codec.LengthSize.
+	LengthUvarint = -1
+	// DefaultMaxFrameLength is used when Codec.MaxFrameLength is zero.
+	DefaultMaxFrameLength = 16 << 20
+
+	maxInt = int(^uint(0) >> 1)
+)
+
+var (
+	// ErrBadLength reports a length field that is malformed, or negative when
+	// a 4 byte field is read as the int32 used by IntToBytes.
+	ErrBadLength = errors.New("pack: bad frame length")
+	// ErrFrameTooLarge reports a frame longer than Codec.MaxFrameLength.
+	ErrFrameTooLarge = errors.New("pack: frame too large")
+	// ErrChecksum reports a frame whose CRC32 trailer does not match.
+	ErrChecksum = errors.New("pack: checksum mismatch")
+
+	errIncomplete = errors.New("pack: incomplete frame")
+)
+
+// Codec describes a frame layout: Magic, followed by the payload length, the
+// payload itself and an optional CRC32 trailer.
+type Codec struct {
+	// Magic marks the start of every frame and is used to resync on garbage.
+	// It may be empty, in which case frames must follow each other exactly.
+	Magic []byte
+	// LengthSize is the width in bytes of the length field: 1, 2, 4, 8 or
+	// LengthUvarint.
+	LengthSize int
+	// ByteOrder of fixed width length fields. Nil means big endian.
+	ByteOrder binary.ByteOrder
+	// MaxFrameLength is the largest payload accepted when unpacking.
+	// Zero means DefaultMaxFrameLength, a negative value disables the limit.
+	MaxFrameLength int
+	// CRC32 enables a 4 byte checksum trailer over the length field and
+	// payload, computed with this table, e.g. crc32.IEEETable.
+	CRC32 *crc32.Table
+	// Compressor, if set, compresses frame payloads of at least
+	// CompressThreshold bytes in PackFrame and marks them FlagCompressed.
+	// ParseFrame needs it to read such frames.
+	Compressor Compressor
+	// CompressThreshold is the smallest payload worth compressing.
+	// Zero means DefaultCompressThreshold.
+	CompressThreshold int
+	// AEAD, if set, seals every frame in EncodeFrame after compression,
+	// replacing its Seq, and ParseFrame rejects frames it cannot open.
+	// ReliableConn needs its own sequence numbers and cannot use it.
+	AEAD *AEAD
+}
+
+// DefaultCodec is the layout used by Pack and Unpack.
+var DefaultCodec = &Codec{
+	Magic:      []byte(ConstHeader),
+	LengthSize: ConstSaveDataLength,
+	ByteOrder:  binary.BigEndian,
+}
+
+// Pack returns message framed with c's layout.
+func (c *Codec) Pack(message []byte) []byte {
+	return c.AppendPack(make([]byte, 0, c.packedLength(len(message))), message)
+}
+
+// AppendPack appends message framed with c's layout to dst and returns the
+// extended slice. It does not allocate if dst has enough capacity.
+func (c *Codec) AppendPack(dst, message []byte) []byte {
+	start := len(dst)
+	dst = append(dst, c.Magic...)
+	dst = c.appendLength(dst, len(message))
+	dst = append(dst, message...)
+	if c.CRC32 != nil {
+		dst = c.appendChecksum(dst, crc32.Checksum(dst[start+len(c.Magic):], c.CRC32))
+	}
+	return dst
+}
+
+// writeBuffers holds the header, trailer and writev list of one WriteTo
+// call; they are pooled because w keeps them from staying on the stack.
+type writeBuffers struct {
+	header  [64]byte
+	trailer [crc32.Size]byte
+	list    [3][]byte
+	buffers net.Buffers
+}
+
+var writeBuffersPool = sync.Pool{New: func() interface{} { return new(writeBuffers) }}
+
+// WriteTo writes message framed with c's layout to w. The payload is not
+// copied and the call does not allocate; on a *net.TCPConn header, payload
+// and trailer go out in a single writev.
+func (c *Codec) WriteTo(w io.Writer, message []byte) (int64, error) {
+	wb := writeBuffersPool.Get().(*writeBuffers)
+	h := append(wb.header[:0], c.Magic...)
+	h = c.appendLength(h, len(message))
+	wb.buffers = append(wb.list[:0], h, message)
+	if c.CRC32 != nil {
+		sum := crc32.Update(crc32.Checksum(h[len(c.Magic):], c.CRC32), c.CRC32, message)
+		wb.buffers = append(wb.buffers, c.appendChecksum(wb.trailer[:0], sum))
+	}
+	n, err := wb.buffers.WriteTo(w)
+	wb.list = [3][]byte{} // do not keep message alive
+	wb.buffers = nil
+	writeBuffersPool.Put(wb)
+	return n, err
+}
+
+// packedLength returns an upper bound of the framed size of n payload bytes.
+func (c *Codec) packedLength(n int) int {
+	return len(c.Magic) + binary.MaxVarintLen64 + n + crc32.Size
+}
+
+// Unpack sends every complete frame in buffer to readerChannel and returns
+// the bytes left over, which should be prepended to the next read.
+// On a malformed frame it stops with ErrBadLength, ErrFrameTooLarge or
+// ErrChecksum. If c has a Magic the returned bytes skip the bad header and
+// unpacking can resume with them; otherwise the stream cannot be recovered.
+// The frames sent alias buffer.
+func (c *Codec) Unpack(buffer []byte, readerChannel chan []byte) ([]byte, error) {
+	return c.UnpackFunc(buffer, func(data []byte) error {
+		readerChannel <- data
+		return nil
+	})
+}
+
+// UnpackFunc calls fn for every complete frame in buffer, stopping at the
+// first error fn returns, and otherwise behaves like Unpack.
+// The slices passed to fn alias buffer: they must not be retained once buffer
+// is reused, for example by appending the next read to the returned bytes.
+func (c *Codec) UnpackFunc(buffer []byte, fn func([]byte) error) ([]byte, error) {
+	for {
+		data, _, n, err := c.scan(buffer)
+		buffer = buffer[n:]
+		if err == errIncomplete {
+			return buffer, nil
+		}
+		if err != nil {
+			return buffer, err
+		}
+		if err := fn(data); err != nil {
+			return buffer, err
+		}
+	}
+}
+
+// UnpackAll returns all complete frames in buffer and the bytes left over,
+// with the same aliasing and error behavior as UnpackFunc.
+func (c *Codec) UnpackAll(buffer []byte) (frames [][]byte, rest []byte, err error) {
+	rest, err = c.UnpackFunc(buffer, func(data []byte) error {
+		frames = append(frames, data)
+		return nil
+	})
+	return frames, rest, err
+}
+
+// NewDecoder returns a Decoder reading frames in c's layout from r.
+func (c *Codec) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		tracker: tracker{codec: c},
+		r:       r,
+		buf:     make([]byte, defaultDecoderBufferSize),
+	}
+}
+
+// scan looks for the first complete frame in buffer. If one is found it
+// returns the payload and the number of bytes up to and including the frame.
+// Otherwise n is the number of leading bytes to discard and err is
+// errIncomplete if more data is needed, or the reason the frame is invalid.
+// skipped counts the bytes within n that were discarded as garbage.
+func (c *Codec) scan(buffer []byte) (data []byte, skipped, n int, err error) {
+	magic := c.Magic
+	for i := 0; i < len(buffer); i++ {
+		if len(magic) > 0 {
+			j := bytes.Index(buffer[i:], magic)
+			if j < 0 {
+				// keep a tail that may hold the start of a split magic
+				if k := len(buffer) - len(magic) + 1; k > i {
+					i = k
+				}
+				return nil, i, i, errIncomplete
+			}
+			i += j
+		}
+
+		start := i + len(magic)
+		length, ln := c.readLength(buffer[start:])
+		if ln == 0 {
+			return nil, i, i, errIncomplete
+		}
+		if ln < 0 || (c.LengthSize == 4 && length > math.MaxInt32) {
+			return nil, c.skip(i), c.skip(i), ErrBadLength
+		}
+		start += ln
+		if length > uint64(c.maxFrameLength()) || length > uint64(maxInt-start-crc32.Size) {
+			return nil, c.skip(i), c.skip(i), ErrFrameTooLarge
+		}
+		end := start + int(length)
+		if c.CRC32 == nil {
+			if len(buffer) < end {
+				return nil, i, i, errIncomplete
+			}
+			return buffer[start:end], i, end, nil
+		}
+
+		if len(buffer) < end+crc32.Size {
+			return nil, i, i, errIncomplete
+		}
+		sum := c.byteOrder().Uint32(buffer[end:])
+		if crc32.Checksum(buffer[i+len(magic):end], c.CRC32) != sum {
+			return nil, c.skip(i), c.skip(i), ErrChecksum
+		}
+		return buffer[start:end], i, end + crc32.Size, nil
+	}
+	return nil, len(buffer), len(buffer), errIncomplete
+}
+
+// skip returns how many bytes to discard after a bad header at i: past the
+// start of its magic so scanning resyncs, or nothing if there is no magic.
+func (c *Codec) skip(i int) int {
+	if len(c.Magic) == 0 {
+		return i
+	}
+	return i + 1
+}
+
+func (c *Codec) maxFrameLength() int {
+	switch {
+	case c.MaxFrameLength == 0:
+		return DefaultMaxFrameLength
+	case c.MaxFrameLength < 0:
+		return maxInt
+	}
+	return c.MaxFrameLength
+}
+
+func (c *Codec) compressThreshold() int {
+	if c.CompressThreshold == 0 {
+		return DefaultCompressThreshold
+	}
+	return c.CompressThreshold
+}
+
+func (c *Codec) byteOrder() binary.ByteOrder {
+	if c.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return c.ByteOrder
+}
+
+// appendLength appends n encoded as c's length field.
+func (c *Codec) appendLength(dst []byte, n int) []byte {
+	switch c.LengthSize {
+	case 1:
+		if n > 0xff {
+			panic("pack: message too long for length field")
+		}
+		return append(dst, byte(n))
+	case 2:
+		if n > 0xffff {
+			panic("pack: message too long for length field")
+		}
+		dst = append(dst, 0, 0)
+		c.byteOrder().PutUint16(dst[len(dst)-2:], uint16(n))
+	case 4:
+		if uint64(n) > 0x7fffffff {
+			panic("pack: message too long for length field")
+		}
+		dst = append(dst, 0, 0, 0, 0)
+		c.byteOrder().PutUint32(dst[len(dst)-4:], uint32(n))
+	case 8:
+		dst = append(dst, 0, 0, 0, 0, 0, 0, 0, 0)
+		c.byteOrder().PutUint64(dst[len(dst)-8:], uint64(n))
+	case LengthUvarint:
+		var b [binary.MaxVarintLen64]byte
+		return append(dst, b[:binary.PutUvarint(b[:], uint64(n))]...)
+	default:
+		panic("pack: invalid LengthSize")
+	}
+	return dst
+}
+
+func (c *Codec) appendChecksum(dst []byte, sum uint32) []byte {
+	dst = append(dst, 0, 0, 0, 0)
+	c.byteOrder().PutUint32(dst[len(dst)-crc32.Size:], sum)
+	return dst
+}
+
+// readLength decodes c's length field at the start of b. It returns the
+// length and the size of the field; the size is 0 if b is too short and
+// negative if the field is malformed.
+func (c *Codec) readLength(b []byte) (uint64, int) {
+	if c.LengthSize == LengthUvarint {
+		return binary.Uvarint(b)
+	}
+	if len(b) < c.LengthSize {
+		return 0, 0
+	}
+	switch c.LengthSize {
+	case 1:
+		return uint64(b[0]), 1
+	case 2:
+		return uint64(c.byteOrder().Uint16(b)), 2
+	case 4:
+		return uint64(c.byteOrder().Uint32(b)), 4
+	case 8:
+		return c.byteOrder().Uint64(b), 8
+	}
+	panic("pack: invalid LengthSize")
+}
@@ -0,0 +1,124 @@
+package pack
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// FlagCompressed marks a frame whose payload was compressed by the codec's
+// Compressor. The high flag bits are reserved for this package.
+const FlagCompressed uint16 = 1 << 15
+
+// DefaultCompressThreshold is used when Codec.CompressThreshold is zero.
+const DefaultCompressThreshold = 1024
+
+// ErrCompressed reports a compressed frame read by a codec without Compressor.
+var ErrCompressed = errors.New("pack: compressed frame but no compressor")
+
+// Compressor compresses frame payloads.
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	// Decompress fails with ErrFrameTooLarge if the result exceeds limit bytes.
+	Decompress(src []byte, limit int) ([]byte, error)
+}
+
+// FlateCompressor compresses with compress/flate.
+type FlateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCompressor returns a FlateCompressor using the given flate level.
+func NewFlateCompressor(level int) (*FlateCompressor, error) {
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+	return &FlateCompressor{level: level}, nil
+}
+
+func (fc *FlateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := fc.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, fc.level)
+	} else {
+		w.Reset(&buf)
+	}
+	defer fc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fc *FlateCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// GzipCompressor compresses with compress/gzip.
+type GzipCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewGzipCompressor returns a GzipCompressor using the given gzip level.
+func NewGzipCompressor(level int) (*GzipCompressor, error) {
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+	return &GzipCompressor{level: level}, nil
+}
+
+func (gc *GzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := gc.writers.Get().(*gzip.Writer)
+	if w == nil {
+		w, _ = gzip.NewWriterLevel(&buf, gc.level)
+	} else {
+		w.Reset(&buf)
+	}
+	defer gc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gc *GzipCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// readLimited reads r to the end, failing once more than limit bytes come out.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	if limit < maxInt {
+		r = io.LimitReader(r, int64(limit)+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, ErrFrameTooLarge
+	}
+	return b, nil
+}
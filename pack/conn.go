@@ -0,0 +1,305 @@
+package pack
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultCloseTimeout is how long Close waits by default for queued frames
+// to be written before it drops them.
+const DefaultCloseTimeout = 5 * time.Second
+
+var (
+	// ErrClosed reports use of a FramedConn after Close.
+	ErrClosed = errors.New("pack: use of closed connection")
+	// ErrQueueFull reports that the async writer queue stayed full for the
+	// whole write timeout.
+	ErrQueueFull = errors.New("pack: write queue full")
+)
+
+// FramedConn reads and writes frames over a net.Conn.
+// Writes are safe from multiple goroutines; reads must come from one.
+type FramedConn struct {
+	conn  net.Conn
+	codec *Codec
+	dec   *Decoder
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	closeTimeout time.Duration
+	queueWait    time.Duration
+
+	writeMu sync.Mutex
+
+	queueMu   sync.RWMutex // held for writing while done is closed
+	queue     chan []byte
+	closing   chan struct{} // closed by Close before it takes queueMu
+	done      chan struct{}
+	writerErr error
+	writerEnd chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn returns a FramedConn using DefaultCodec.
+func NewConn(conn net.Conn) *FramedConn {
+	return DefaultCodec.NewConn(conn)
+}
+
+// NewConn returns a FramedConn using c.
+func (c *Codec) NewConn(conn net.Conn) *FramedConn {
+	return &FramedConn{
+		conn:         conn,
+		codec:        c,
+		dec:          c.NewDecoder(conn),
+		closeTimeout: DefaultCloseTimeout,
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Codec returns the codec fc currently uses.
+func (fc *FramedConn) Codec() *Codec {
+	return fc.codec
+}
+
+// SetCodec switches fc to c for all following frames in both directions,
+// for example after a Handshake. It must not run concurrently with reads or
+// writes, and frames already queued by an async writer keep the old codec.
+func (fc *FramedConn) SetCodec(c *Codec) {
+	fc.codec = c
+	fc.dec.codec = c
+}
+
+// Conn returns the underlying connection.
+func (fc *FramedConn) Conn() net.Conn {
+	return fc.conn
+}
+
+// SetReadTimeout makes every ReadFrame fail if no frame arrives within d.
+// Zero disables the timeout.
+func (fc *FramedConn) SetReadTimeout(d time.Duration) {
+	fc.readTimeout = d
+}
+
+// SetWriteTimeout makes every write to the connection fail if it does not
+// complete within d. Zero disables the timeout.
+func (fc *FramedConn) SetWriteTimeout(d time.Duration) {
+	fc.writeTimeout = d
+}
+
+// SetCloseTimeout limits how long Close waits for queued frames to be
+// written, after which it closes the connection and they are lost.
+// Zero waits forever.
+func (fc *FramedConn) SetCloseTimeout(d time.Duration) {
+	fc.closeTimeout = d
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (fc *FramedConn) SetReadDeadline(t time.Time) error {
+	return fc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (fc *FramedConn) SetWriteDeadline(t time.Time) error {
+	return fc.conn.SetWriteDeadline(t)
+}
+
+// ReadFrame returns the payload of the next frame. The slice is only valid
+// until the next call to ReadFrame.
+// On ErrTooManyResyncs the connection is closed.
+func (fc *FramedConn) ReadFrame() ([]byte, error) {
+	if fc.readTimeout > 0 {
+		fc.conn.SetReadDeadline(time.Now().Add(fc.readTimeout))
+	}
+	data, err := fc.dec.Next()
+	if err == ErrTooManyResyncs {
+		fc.conn.Close()
+	}
+	return data, err
+}
+
+// Stats returns the read side counters of the connection.
+func (fc *FramedConn) Stats() Stats {
+	return fc.dec.Stats()
+}
+
+// SetMaxResyncs makes ReadFrame drop the connection once the peer's stream
+// lost alignment more than n times. Zero means no limit.
+func (fc *FramedConn) SetMaxResyncs(n int) {
+	fc.dec.SetMaxResyncs(n)
+}
+
+// WriteFrame writes message as one frame. In async mode it only queues a
+// copy, blocking while the queue is full.
+func (fc *FramedConn) WriteFrame(message []byte) error {
+	if fc.queue == nil {
+		return fc.write(message)
+	}
+
+	// Close cannot close done while a frame is on its way into the queue, so
+	// the writer's final flush sees every frame accepted here. Close closes
+	// closing first, which wakes a WriteFrame waiting for room.
+	fc.queueMu.RLock()
+	defer fc.queueMu.RUnlock()
+	select {
+	case <-fc.closing:
+		return fc.closedErr()
+	default:
+	}
+	packed := fc.codec.Pack(message)
+	var timeout <-chan time.Time
+	if fc.queueWait > 0 {
+		t := time.NewTimer(fc.queueWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case fc.queue <- packed:
+		return nil
+	case <-fc.closing:
+		return fc.closedErr()
+	case <-fc.writerEnd:
+		return fc.closedErr()
+	case <-timeout:
+		return ErrQueueFull
+	}
+}
+
+// writeFrame encodes f with fc's codec and writes it.
+func writeFrame(fc *FramedConn, f Frame) error {
+	b, err := fc.codec.EncodeFrame(nil, f)
+	if err != nil {
+		return err
+	}
+	return fc.WriteFrame(b)
+}
+
+func (fc *FramedConn) write(message []byte) error {
+	select {
+	case <-fc.done:
+		return ErrClosed
+	default:
+	}
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	if fc.writeTimeout > 0 {
+		fc.conn.SetWriteDeadline(time.Now().Add(fc.writeTimeout))
+	}
+	_, err := fc.codec.WriteTo(fc.conn, message)
+	return err
+}
+
+// StartWriter switches fc to async mode: WriteFrame queues up to queueSize
+// frames which a background goroutine writes until Close. When the queue is
+// full WriteFrame waits up to maxWait for room, then fails with ErrQueueFull;
+// zero maxWait waits forever.
+// It must be called before the first WriteFrame.
+func (fc *FramedConn) StartWriter(queueSize int, maxWait time.Duration) {
+	fc.queueWait = maxWait
+	fc.queue = make(chan []byte, queueSize)
+	fc.writerEnd = make(chan struct{})
+	go fc.writer()
+}
+
+// QueueLen returns the number of frames waiting in the async writer queue.
+func (fc *FramedConn) QueueLen() int {
+	return len(fc.queue)
+}
+
+func (fc *FramedConn) writer() {
+	defer close(fc.writerEnd)
+	for {
+		select {
+		case packed := <-fc.queue:
+			if !fc.writePacked(packed) {
+				return
+			}
+		case <-fc.done:
+			// flush what was queued before Close
+			for {
+				select {
+				case packed := <-fc.queue:
+					if !fc.writePacked(packed) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (fc *FramedConn) writePacked(packed []byte) bool {
+	if err := fc.writeRaw(packed); err != nil {
+		fc.writerErr = err
+		fc.conn.Close()
+		return false
+	}
+	return true
+}
+
+// writeRaw writes already packed frames.
+func (fc *FramedConn) writeRaw(packed []byte) error {
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	if fc.writeTimeout > 0 {
+		fc.conn.SetWriteDeadline(time.Now().Add(fc.writeTimeout))
+	}
+	_, err := fc.conn.Write(packed)
+	return err
+}
+
+func (fc *FramedConn) closedErr() error {
+	if fc.writerEnd != nil {
+		select {
+		case <-fc.writerEnd:
+			if fc.writerErr != nil {
+				return fc.writerErr
+			}
+		default:
+		}
+	}
+	return ErrClosed
+}
+
+// Close flushes the async writer queue, if any, and closes the connection.
+// If the flush takes longer than the close timeout, the connection is
+// closed anyway and Close returns the error that stopped the writer.
+func (fc *FramedConn) Close() error {
+	err := ErrClosed
+	fc.closeOnce.Do(func() {
+		close(fc.closing)
+		fc.queueMu.Lock()
+		close(fc.done)
+		fc.queueMu.Unlock()
+		if fc.writerEnd != nil && !fc.awaitFlush(fc.writerEnd) {
+			err = fc.writerErr
+			return
+		}
+		err = fc.conn.Close()
+	})
+	return err
+}
+
+// awaitFlush waits for end to be closed by a goroutine writing to fc. If
+// that takes longer than the close timeout it closes the connection to stop
+// the writes, waits for end and returns false.
+func (fc *FramedConn) awaitFlush(end <-chan struct{}) bool {
+	if fc.closeTimeout <= 0 {
+		<-end
+		return true
+	}
+	t := time.NewTimer(fc.closeTimeout)
+	defer t.Stop()
+	select {
+	case <-end:
+		return true
+	case <-t.C:
+		fc.conn.Close()
+		<-end
+		return false
+	}
+}
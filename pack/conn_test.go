@@ -0,0 +1,495 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFramedConn(t *testing.T) {
+	cli, srv := net.Pipe()
+	client, server := NewConn(cli), NewConn(srv)
+	defer client.Close()
+	defer server.Close()
+
+	const writers, frames = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < frames; i++ {
+				if err := client.WriteFrame([]byte(fmt.Sprintf("%d:%d", w, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	next := make([]int, writers)
+	for n := 0; n < writers*frames; n++ {
+		data, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w, i int
+		if _, err := fmt.Sscanf(string(data), "%d:%d", &w, &i); err != nil || i != next[w] {
+			t.Fatalf("got %q, want writer %d frame %d", data, w, next[w])
+		}
+		next[w]++
+	}
+	wg.Wait()
+}
+
+func TestFramedConnAsync(t *testing.T) {
+	cli, srv := net.Pipe()
+	client, server := NewConn(cli), NewConn(srv)
+	defer server.Close()
+
+	client.StartWriter(4, 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if err := client.WriteFrame([]byte{byte(i)}); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	// the writer is stuck on frame 0 since nobody reads, and the queue is full
+	if err := client.WriteFrame([]byte{5}); err != ErrQueueFull {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+	if n := client.QueueLen(); n != 4 {
+		t.Fatalf("queue holds %d frames, want 4", n)
+	}
+
+	server.SetReadTimeout(time.Second)
+	closed := make(chan error)
+	go func() { closed <- client.Close() }()
+	for i := 0; i < 5; i++ {
+		data, err := server.ReadFrame()
+		if err != nil || len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("frame %d: got %v, %v", i, data, err)
+		}
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := client.WriteFrame(nil); err != ErrClosed {
+		t.Fatalf("after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestFramedConnReadTimeout(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	server := NewConn(srv)
+	defer server.Close()
+
+	server.SetReadTimeout(10 * time.Millisecond)
+	if _, err := server.ReadFrame(); err == nil {
+		t.Fatal("ReadFrame did not time out")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// the timeout is not sticky: the next read gets the frame
+	go cli.Write(Pack([]byte("late")))
+	server.SetReadTimeout(time.Second)
+	if data, err := server.ReadFrame(); err != nil || string(data) != "late" {
+		t.Fatalf("after timeout: got %q, %v", data, err)
+	}
+}
+
+func TestFramedConnCloseRace(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		cli, srv := net.Pipe()
+		client, server := NewConn(cli), NewConn(srv)
+		client.StartWriter(8, 0)
+
+		var accepted int32
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for client.WriteFrame([]byte("x")) == nil {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}()
+		}
+		go func() {
+			time.Sleep(time.Millisecond)
+			client.Close()
+		}()
+
+		var received int32
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				break
+			}
+			received++
+		}
+		wg.Wait()
+		server.Close()
+		if n := atomic.LoadInt32(&accepted); n != received {
+			t.Fatalf("round %d: %d frames accepted, %d received", round, n, received)
+		}
+	}
+}
+
+func TestFramedConnCloseStalledPeer(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close() // the peer never reads
+	client := NewConn(cli)
+	client.SetCloseTimeout(20 * time.Millisecond)
+	client.StartWriter(1, 0)
+
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() { errs <- client.WriteFrame([]byte("stuck")) }()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close() }()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatal("Close reported a complete flush")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close hung on a peer that does not read")
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-errs:
+		case <-time.After(time.Second):
+			t.Fatal("WriteFrame hung after Close")
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	cli, srv := net.Pipe()
+	client := NewKeepalive(NewConn(cli), 5*time.Millisecond, time.Second)
+	server := NewKeepalive(NewConn(srv), 5*time.Millisecond, time.Second)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(5 * time.Millisecond)
+			client.WriteFrame(Frame{Type: 1, Seq: uint32(i)})
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		f, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != 1 || f.Seq != uint32(i) {
+			t.Fatalf("got %+v, want application frame %d", f, i)
+		}
+	}
+	if server.RTT() <= 0 {
+		t.Fatal("no RTT measured")
+	}
+}
+
+func TestKeepaliveIdle(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	// the peer reads but never answers
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := cli.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	server := NewKeepalive(NewConn(srv), 5*time.Millisecond, 30*time.Millisecond)
+	if _, err := server.ReadFrame(); err != ErrIdleTimeout {
+		t.Fatalf("got %v, want ErrIdleTimeout", err)
+	}
+	if err := server.WriteFrame(Frame{}); err != ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
+
+func TestKeepaliveIdleStalled(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close() // the peer neither reads nor answers
+
+	fc := NewConn(srv)
+	fc.SetCloseTimeout(20 * time.Millisecond)
+	fc.StartWriter(1, 0)
+	server := NewKeepalive(fc, 5*time.Millisecond, 30*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.ReadFrame()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrIdleTimeout {
+			t.Fatalf("got %v, want ErrIdleTimeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle peer was not dropped")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	cli, srv := net.Pipe()
+	client, server := NewConn(cli), NewConn(srv)
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		n   Negotiated
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := ServerHandshake(server, HandshakeConfig{
+			Version:    3,
+			MinVersion: 1,
+			Features:   FeatureCompression | FeatureChecksum,
+		})
+		done <- result{n, err}
+	}()
+	cn, err := ClientHandshake(client, HandshakeConfig{
+		Version:    2,
+		MinVersion: 1,
+		Features:   FeatureChecksum | FeatureEncryption,
+		ClientID:   "player-7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	for _, n := range []Negotiated{cn, r.n} {
+		if n.Version != 2 || n.Features != FeatureChecksum || n.ClientID != "player-7" {
+			t.Fatalf("got %+v, want version 2 with checksums", n)
+		}
+	}
+	if client.Codec().CRC32 == nil || server.Codec().CRC32 == nil || client.Codec().Compressor != nil {
+		t.Fatal("connections did not switch to the negotiated codec")
+	}
+
+	go client.WriteFrame(client.Codec().AppendFrame(nil, Frame{Type: 1, Payload: []byte("hi")}))
+	data, err := server.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := server.Codec().ParseFrame(data); err != nil || string(f.Payload) != "hi" {
+		t.Fatalf("got %+v, %v", f, err)
+	}
+}
+
+func TestHandshakeEncryption(t *testing.T) {
+	cli, srv := net.Pipe()
+	raw := &recordingConn{Conn: cli}
+	client, server := NewConn(raw), NewConn(srv)
+	defer client.Close()
+	defer server.Close()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	clientAEAD, _ := NewAESGCM(key, false)
+	serverAEAD, _ := NewAESGCM(key, true)
+	done := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(server, HandshakeConfig{Features: FeatureEncryption, AEAD: serverAEAD})
+		done <- err
+	}()
+	n, err := ClientHandshake(client, HandshakeConfig{Features: FeatureEncryption, AEAD: clientAEAD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n.Features != FeatureEncryption || n.Codec.AEAD != clientAEAD {
+		t.Fatalf("got %+v, want encryption", n)
+	}
+
+	go client.WriteFrame(client.Codec().AppendFrame(nil, Frame{Type: 1, Payload: []byte("secret")}))
+	data, err := server.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := server.Codec().ParseFrame(data); err != nil || string(f.Payload) != "secret" {
+		t.Fatalf("got %+v, %v", f, err)
+	}
+	if bytes.Contains(raw.written(), []byte("secret")) {
+		t.Fatal("payload sent in the clear")
+	}
+	if _, err := server.Codec().ParseFrame(AppendFrame(nil, Frame{Type: 1})); err != ErrDecrypt {
+		t.Fatalf("plain frame: got %v, want ErrDecrypt", err)
+	}
+
+	// without an AEAD encryption is not offered
+	cli, srv = net.Pipe()
+	client, server = NewConn(cli), NewConn(srv)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_, err := ServerHandshake(server, HandshakeConfig{Features: FeatureEncryption, AEAD: serverAEAD})
+		done <- err
+	}()
+	if n, err := ClientHandshake(client, HandshakeConfig{Features: FeatureEncryption}); err != nil || n.Features != 0 {
+		t.Fatalf("got %+v, %v", n, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingConn keeps a copy of everything written to a net.Conn.
+type recordingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.buf = append(c.buf, p...)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.buf...)
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	cli, srv := net.Pipe()
+	client, server := NewConn(cli), NewConn(srv)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(server, HandshakeConfig{Version: 5, MinVersion: 4})
+		done <- err
+	}()
+	_, err := ClientHandshake(client, HandshakeConfig{Version: 3, MinVersion: 1})
+	if _, ok := err.(*HandshakeError); !ok {
+		t.Fatalf("got %v, want a HandshakeError", err)
+	}
+	if err := <-done; err != ErrVersionMismatch {
+		t.Fatalf("got %v, want ErrVersionMismatch", err)
+	}
+}
+
+// countingConn counts the writes to a net.Conn.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestSendQueue(t *testing.T) {
+	cli, srv := net.Pipe()
+	counted := &countingConn{Conn: cli}
+	server := NewConn(srv)
+	defer server.Close()
+
+	const movement, chat, bulk = 0, 1, 2
+	q := NewSendQueue(NewConn(counted),
+		ClassConfig{Budget: 40, Policy: DropOldest},
+		ClassConfig{Budget: 40, Policy: Reject},
+		ClassConfig{},
+	)
+	// the writer blocks on the snapshot until the server reads
+	if err := q.Send(bulk, []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	for q.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		if err := q.Send(movement, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Send(chat, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send(chat, []byte("again")); err != ErrQueueFull {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+	if err := q.Send(bulk, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := q.Stats()
+	if stats[movement].Frames != 2 || stats[movement].Dropped != 3 || stats[chat].Bytes != len(Pack([]byte("hi"))) {
+		t.Fatalf("got stats %+v", stats)
+	}
+
+	go q.Close()
+	want := []string{"snapshot", "\x03", "\x04", "hi", string(make([]byte, 100))}
+	for _, w := range want {
+		data, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != w {
+			t.Fatalf("got %q, want %q", data, w)
+		}
+	}
+	if n := atomic.LoadInt32(&counted.writes); n != 2 {
+		t.Fatalf("frames went out in %d writes, want 2", n)
+	}
+}
+
+func TestSendQueueCloseStalledPeer(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close() // the peer never reads
+	fc := NewConn(cli)
+	fc.SetCloseTimeout(20 * time.Millisecond)
+	q := NewSendQueue(fc, ClassConfig{})
+	for i := 0; i < 3; i++ {
+		if err := q.Send(0, []byte("stuck")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- q.Close() }()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatal("Close reported a complete flush")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close hung on a peer that does not read")
+	}
+	if err := q.Send(0, []byte("late")); err == nil {
+		t.Fatal("Send succeeded after Close")
+	}
+}
@@ -0,0 +1,212 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// FragmentHeaderLength is the size of the header in front of every datagram
+// fragment: message id, fragment index and fragment count, all big endian.
+const FragmentHeaderLength = 8
+
+const maxFragments = 0xffff
+
+// fragmentOverhead is charged against a Reassembler's memory bound for
+// every fragment on top of its payload, so header-only fragments count too.
+const fragmentOverhead = 64
+
+var (
+	// ErrMessageTooLarge reports a message that needs more than 65535
+	// fragments.
+	ErrMessageTooLarge = errors.New("pack: message too large for datagrams")
+	// ErrBadFragment reports a datagram that is not a valid fragment.
+	ErrBadFragment = errors.New("pack: bad fragment")
+)
+
+// Fragmenter splits messages into datagrams of at most MTU bytes.
+type Fragmenter struct {
+	mtu int
+
+	mu     sync.Mutex
+	nextID uint32
+}
+
+// NewFragmenter returns a Fragmenter for datagrams of at most mtu bytes.
+func NewFragmenter(mtu int) *Fragmenter {
+	if mtu <= FragmentHeaderLength {
+		panic("pack: MTU too small")
+	}
+	return &Fragmenter{mtu: mtu}
+}
+
+// Split returns the datagrams carrying message, each with its own buffer.
+func (f *Fragmenter) Split(message []byte) ([][]byte, error) {
+	chunk := f.mtu - FragmentHeaderLength
+	count := (len(message) + chunk - 1) / chunk
+	if count == 0 {
+		count = 1
+	}
+	if count > maxFragments {
+		return nil, ErrMessageTooLarge
+	}
+
+	f.mu.Lock()
+	id := f.nextID
+	f.nextID++
+	f.mu.Unlock()
+
+	datagrams := make([][]byte, count)
+	for i := range datagrams {
+		part := message[i*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+		d := make([]byte, FragmentHeaderLength, FragmentHeaderLength+len(part))
+		binary.BigEndian.PutUint32(d[0:], id)
+		binary.BigEndian.PutUint16(d[4:], uint16(i))
+		binary.BigEndian.PutUint16(d[6:], uint16(count))
+		datagrams[i] = append(d, part...)
+	}
+	return datagrams, nil
+}
+
+type pendingMessage struct {
+	count int
+	parts map[int][]byte // by index, only for fragments that arrived
+	size  int            // bytes charged, including fragmentOverhead
+	first time.Time
+}
+
+// Reassembler rebuilds messages from the datagrams of one peer. Incomplete
+// messages are dropped after a timeout or when they would take more than
+// the memory bound.
+type Reassembler struct {
+	timeout  time.Duration
+	maxBytes int
+
+	mu      sync.Mutex
+	pending map[uint32]*pendingMessage
+	order   []uint32 // pending ids, oldest first
+	size    int
+	dropped uint64
+}
+
+// NewReassembler returns a Reassembler keeping incomplete messages for at
+// most timeout and buffering at most maxBytes of fragments, counting a small
+// fixed overhead per fragment.
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		pending:  make(map[uint32]*pendingMessage),
+	}
+}
+
+// Add takes one datagram and returns the message it completes, or nil.
+// A completed empty message is returned as an empty, non-nil slice.
+// The datagram is copied if it has to be kept.
+func (r *Reassembler) Add(datagram []byte) ([]byte, error) {
+	if len(datagram) < FragmentHeaderLength {
+		return nil, ErrBadFragment
+	}
+	id := binary.BigEndian.Uint32(datagram[0:])
+	index := int(binary.BigEndian.Uint16(datagram[4:]))
+	count := int(binary.BigEndian.Uint16(datagram[6:]))
+	part := datagram[FragmentHeaderLength:]
+	cost := len(part) + fragmentOverhead
+	if count == 0 || index >= count || cost > r.maxBytes {
+		return nil, ErrBadFragment
+	}
+	if count == 1 {
+		message := make([]byte, len(part))
+		copy(message, part)
+		return message, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.expire(now)
+
+	m, ok := r.pending[id]
+	if !ok {
+		m = &pendingMessage{count: count, parts: make(map[int][]byte), first: now}
+		r.pending[id] = m
+		r.order = append(r.order, id)
+	}
+	if m.count != count {
+		r.drop(id)
+		return nil, ErrBadFragment
+	}
+	if _, ok := m.parts[index]; ok {
+		return nil, nil
+	}
+
+	for r.size+cost > r.maxBytes && r.order[0] != id {
+		r.drop(r.order[0])
+	}
+	if r.size+cost > r.maxBytes {
+		r.drop(id)
+		return nil, nil
+	}
+	m.parts[index] = append([]byte{}, part...)
+	m.size += cost
+	r.size += cost
+	if len(m.parts) < count {
+		return nil, nil
+	}
+
+	message := make([]byte, 0, m.size-count*fragmentOverhead)
+	for i := 0; i < count; i++ {
+		message = append(message, m.parts[i]...)
+	}
+	r.remove(id)
+	return message, nil
+}
+
+// Expire drops messages still incomplete after the timeout. Add calls it
+// too; calling it periodically only frees memory sooner.
+func (r *Reassembler) Expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+}
+
+// Dropped returns how many incomplete messages were dropped so far.
+func (r *Reassembler) Dropped() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// Buffered returns the number of bytes held for incomplete messages, as
+// counted against the memory bound.
+func (r *Reassembler) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for len(r.order) > 0 && now.Sub(r.pending[r.order[0]].first) > r.timeout {
+		r.drop(r.order[0])
+	}
+}
+
+func (r *Reassembler) drop(id uint32) {
+	r.remove(id)
+	r.dropped++
+}
+
+func (r *Reassembler) remove(id uint32) {
+	r.size -= r.pending[id].size
+	delete(r.pending, id)
+	for i, o := range r.order {
+		if o == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
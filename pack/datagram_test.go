@@ -0,0 +1,129 @@
+package pack
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramLoopback(t *testing.T) {
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no UDP loopback:", err)
+	}
+	defer srv.Close()
+	cli, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	messages := [][]byte{[]byte("small"), nil, make([]byte, 10000)}
+	rand.Read(messages[2])
+
+	f := NewFragmenter(1200)
+	go func() {
+		for _, m := range messages {
+			datagrams, err := f.Split(m)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, d := range datagrams {
+				cli.WriteTo(d, srv.LocalAddr())
+			}
+		}
+	}()
+
+	r := NewReassembler(time.Second, 1<<20)
+	buf := make([]byte, 1500)
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range messages {
+		var got []byte
+		for got == nil {
+			n, _, err := srv.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 1200 {
+				t.Fatalf("datagram of %d bytes", n)
+			}
+			if got, err = r.Add(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("%d bytes left buffered", r.Buffered())
+	}
+}
+
+func TestReassemblerDrops(t *testing.T) {
+	f := NewFragmenter(FragmentHeaderLength + 10)
+	a, _ := f.Split(make([]byte, 30))
+	b, _ := f.Split(make([]byte, 30))
+
+	// out of order and duplicated fragments still complete a message
+	r := NewReassembler(time.Hour, 1000)
+	for _, d := range [][]byte{a[2], a[0], a[0]} {
+		if m, err := r.Add(d); m != nil || err != nil {
+			t.Fatalf("early message: %v, %v", m, err)
+		}
+	}
+	if m, err := r.Add(a[1]); len(m) != 30 || err != nil {
+		t.Fatalf("got %d bytes, %v", len(m), err)
+	}
+
+	// memory bound drops the oldest incomplete message
+	r = NewReassembler(time.Hour, 2*(10+fragmentOverhead)+5)
+	r.Add(a[0])
+	r.Add(a[1])
+	r.Add(b[0])
+	if r.Dropped() != 1 || r.Buffered() != 10+fragmentOverhead {
+		t.Fatalf("dropped %d, buffered %d", r.Dropped(), r.Buffered())
+	}
+
+	// timeout drops incomplete messages
+	r = NewReassembler(10*time.Millisecond, 1000)
+	r.Add(a[0])
+	time.Sleep(20 * time.Millisecond)
+	r.Expire()
+	if r.Dropped() != 1 || r.Buffered() != 0 {
+		t.Fatalf("dropped %d, buffered %d", r.Dropped(), r.Buffered())
+	}
+
+	if _, err := r.Add([]byte{0, 0, 0, 0, 0, 2, 0, 2}); err != ErrBadFragment {
+		t.Fatalf("got %v, want ErrBadFragment", err)
+	}
+
+	// a repeated empty fragment does not complete a message
+	r = NewReassembler(time.Hour, 1000)
+	empty := []byte{0, 0, 0, 9, 0, 0, 0, 2}
+	for i := 0; i < 2; i++ {
+		if m, err := r.Add(empty); m != nil || err != nil {
+			t.Fatalf("duplicate empty fragment: got %q, %v", m, err)
+		}
+	}
+	if m, err := r.Add([]byte{0, 0, 0, 9, 0, 1, 0, 2, 'x'}); string(m) != "x" || err != nil {
+		t.Fatalf("got %q, %v", m, err)
+	}
+}
+
+func TestReassemblerHeaderFlood(t *testing.T) {
+	// header-only fragments of huge messages are bounded by maxBytes
+	r := NewReassembler(time.Hour, 1000)
+	for id := 0; id < 2000; id++ {
+		r.Add([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id), 0, 0, 0xff, 0xff})
+		if r.Buffered() > 1000 || len(r.pending) > 1000/fragmentOverhead {
+			t.Fatalf("after %d fragments: %d bytes, %d messages pending", id+1, r.Buffered(), len(r.pending))
+		}
+	}
+	if r.Dropped() == 0 {
+		t.Fatal("nothing dropped")
+	}
+}
@@ -0,0 +1,113 @@
+package pack
+
+import (
+	"io"
+	"net"
+)
+
+const defaultDecoderBufferSize = 4096
+
+// Decoder reads frames written by Pack from an io.Reader.
+// It keeps its own buffer across calls, counts Stats and starts no goroutines.
+type Decoder struct {
+	tracker
+	r     io.Reader
+	buf   []byte
+	start int // buf[start:end] holds bytes read but not yet decoded
+	end   int
+	err   error
+}
+
+// NewDecoder returns a Decoder reading frames in DefaultCodec's layout from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return DefaultCodec.NewDecoder(r)
+}
+
+// Next returns the payload of the next frame.
+// The returned slice points into the decoder's buffer and is only valid until
+// the next call to Next.
+// Next returns io.EOF when the reader ends on a frame boundary and
+// io.ErrUnexpectedEOF when it ends in the middle of a frame.
+// Malformed frames are reported as in Codec.Unpack; if the codec has a Magic
+// the following call resyncs to the next frame. A read timeout is returned
+// once and the following call reads again; other read errors are final.
+func (d *Decoder) Next() ([]byte, error) {
+	for {
+		data, n, err := d.scan(d.buf[d.start:d.end])
+		d.start += n
+		if err == nil {
+			return data, nil
+		}
+		if err != errIncomplete {
+			return nil, err
+		}
+
+		if d.err != nil {
+			err := d.err
+			if err == io.EOF && d.start < d.end {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				d.err = nil
+			}
+			return nil, err
+		}
+		d.fill()
+	}
+}
+
+// Reset makes d read from r, discarding buffered data and any read error.
+// Stats keep counting across streams.
+func (d *Decoder) Reset(r io.Reader) {
+	d.r = r
+	d.start, d.end = 0, 0
+	d.err = nil
+	d.mu.Lock()
+	d.lost = false
+	d.mu.Unlock()
+}
+
+// skip discards the first buffered byte, so that after a frame cut short
+// by the end of the stream the next call looks for a frame behind it.
+// It reports whether there was a byte to discard.
+func (d *Decoder) skip() bool {
+	if d.start == d.end {
+		return false
+	}
+	d.start++
+	d.mu.Lock()
+	d.stats.Bytes++
+	d.stats.Skipped++
+	if !d.lost {
+		d.lost = true
+		d.stats.Resyncs++
+	}
+	d.mu.Unlock()
+	return true
+}
+
+// fill reads more data into the buffer, compacting or growing it first.
+func (d *Decoder) fill() {
+	if d.start > 0 {
+		d.end = copy(d.buf, d.buf[d.start:d.end])
+		d.start = 0
+	}
+	if d.end == len(d.buf) {
+		buf := make([]byte, 2*len(d.buf))
+		copy(buf, d.buf[:d.end])
+		d.buf = buf
+	}
+
+	for i := 0; i < 100; i++ {
+		n, err := d.r.Read(d.buf[d.end:])
+		d.end += n
+		if err != nil {
+			d.err = err
+			return
+		}
+		if n > 0 {
+			return
+		}
+	}
+	d.err = io.ErrNoProgress
+}
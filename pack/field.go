@@ -0,0 +1,218 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrBadVarint reports a varint that overflows 64 bits.
+var ErrBadVarint = errors.New("pack: bad varint")
+
+// FieldWriter encodes fields for hand-written binary payloads. Strings and
+// byte slices are prefixed with their length as a uvarint.
+type FieldWriter struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// NewFieldWriter returns a FieldWriter using order for fixed width fields,
+// or big endian if order is nil.
+func NewFieldWriter(order binary.ByteOrder) *FieldWriter {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	return &FieldWriter{order: order}
+}
+
+// Bytes returns the encoded fields. The slice is reused after Reset.
+func (w *FieldWriter) Bytes() []byte { return w.buf }
+
+// Len returns the number of bytes written.
+func (w *FieldWriter) Len() int { return len(w.buf) }
+
+// Reset empties w, keeping its buffer.
+func (w *FieldWriter) Reset() { w.buf = w.buf[:0] }
+
+func (w *FieldWriter) grow(n int) []byte {
+	w.buf = append(w.buf, make([]byte, n)...)
+	return w.buf[len(w.buf)-n:]
+}
+
+func (w *FieldWriter) WriteUint8(v uint8)   { w.buf = append(w.buf, v) }
+func (w *FieldWriter) WriteUint16(v uint16) { w.order.PutUint16(w.grow(2), v) }
+func (w *FieldWriter) WriteUint32(v uint32) { w.order.PutUint32(w.grow(4), v) }
+func (w *FieldWriter) WriteUint64(v uint64) { w.order.PutUint64(w.grow(8), v) }
+
+func (w *FieldWriter) WriteInt8(v int8)   { w.WriteUint8(uint8(v)) }
+func (w *FieldWriter) WriteInt16(v int16) { w.WriteUint16(uint16(v)) }
+func (w *FieldWriter) WriteInt32(v int32) { w.WriteUint32(uint32(v)) }
+func (w *FieldWriter) WriteInt64(v int64) { w.WriteUint64(uint64(v)) }
+
+func (w *FieldWriter) WriteFloat32(v float32) { w.WriteUint32(math.Float32bits(v)) }
+func (w *FieldWriter) WriteFloat64(v float64) { w.WriteUint64(math.Float64bits(v)) }
+
+func (w *FieldWriter) WriteBool(v bool) {
+	if v {
+		w.WriteUint8(1)
+	} else {
+		w.WriteUint8(0)
+	}
+}
+
+// WriteVarint writes v zigzag encoded, so small negative numbers stay short.
+func (w *FieldWriter) WriteVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (w *FieldWriter) WriteUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *FieldWriter) WriteBytes(v []byte) {
+	w.WriteUvarint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *FieldWriter) WriteString(v string) {
+	w.WriteUvarint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// FieldReader decodes fields written by a FieldWriter with the same byte
+// order. Reads past the end fail with io.ErrUnexpectedEOF and consume nothing.
+type FieldReader struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// NewFieldReader returns a FieldReader over b, using order for fixed width
+// fields, or big endian if order is nil.
+func NewFieldReader(b []byte, order binary.ByteOrder) *FieldReader {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	return &FieldReader{buf: b, order: order}
+}
+
+// Len returns the number of unread bytes.
+func (r *FieldReader) Len() int { return len(r.buf) }
+
+func (r *FieldReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *FieldReader) ReadUint8() (uint8, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *FieldReader) ReadUint16() (uint16, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return r.order.Uint16(b), nil
+}
+
+func (r *FieldReader) ReadUint32() (uint32, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return r.order.Uint32(b), nil
+}
+
+func (r *FieldReader) ReadUint64() (uint64, error) {
+	b, err := r.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return r.order.Uint64(b), nil
+}
+
+func (r *FieldReader) ReadInt8() (int8, error) {
+	v, err := r.ReadUint8()
+	return int8(v), err
+}
+
+func (r *FieldReader) ReadInt16() (int16, error) {
+	v, err := r.ReadUint16()
+	return int16(v), err
+}
+
+func (r *FieldReader) ReadInt32() (int32, error) {
+	v, err := r.ReadUint32()
+	return int32(v), err
+}
+
+func (r *FieldReader) ReadInt64() (int64, error) {
+	v, err := r.ReadUint64()
+	return int64(v), err
+}
+
+func (r *FieldReader) ReadFloat32() (float32, error) {
+	v, err := r.ReadUint32()
+	return math.Float32frombits(v), err
+}
+
+func (r *FieldReader) ReadFloat64() (float64, error) {
+	v, err := r.ReadUint64()
+	return math.Float64frombits(v), err
+}
+
+func (r *FieldReader) ReadBool() (bool, error) {
+	v, err := r.ReadUint8()
+	return v != 0, err
+}
+
+func (r *FieldReader) ReadVarint() (int64, error) {
+	v, n := binary.Varint(r.buf)
+	return v, r.varint(n)
+}
+
+func (r *FieldReader) ReadUvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	return v, r.varint(n)
+}
+
+func (r *FieldReader) varint(n int) error {
+	switch {
+	case n == 0:
+		return io.ErrUnexpectedEOF
+	case n < 0:
+		return ErrBadVarint
+	}
+	r.buf = r.buf[n:]
+	return nil
+}
+
+// ReadBytes returns a length prefixed byte slice, aliasing the reader's input.
+func (r *FieldReader) ReadBytes() ([]byte, error) {
+	buf := r.buf
+	n, err := r.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.buf)) {
+		r.buf = buf
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r.next(int(n))
+}
+
+func (r *FieldReader) ReadString() (string, error) {
+	b, err := r.ReadBytes()
+	return string(b), err
+}
@@ -0,0 +1,161 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FrameHeaderLength is the size of the header PackFrame puts before the
+// payload: type, flags and sequence number, all big endian.
+const FrameHeaderLength = 8
+
+// TypeReserved is the first frame type reserved for control frames of this
+// package. Applications should use types below it.
+const TypeReserved uint16 = 0xff00
+
+// FlagsReserved are the Frame.Flags bits used by this package; applications
+// should leave them clear. AppendFrame owns FlagCompressed and clears it
+// before deciding on compression, while FlagEncrypted is set by AEAD.Seal
+// and FlagAck and FlagFin by ReliableConn.
+const FlagsReserved = FlagCompressed | FlagEncrypted | FlagAck | FlagFin
+
+// ErrShortFrame reports a frame body too short to hold a frame header.
+var ErrShortFrame = errors.New("pack: frame shorter than header")
+
+// Frame is a message with the extended header used by PackFrame.
+type Frame struct {
+	Type    uint16
+	Flags   uint16
+	Seq     uint32
+	Payload []byte
+}
+
+// AppendFrame appends the header and payload of f to dst, giving the body
+// that Pack wraps. It is EncodeFrame for codecs without an AEAD, and panics
+// where EncodeFrame would fail.
+func (c *Codec) AppendFrame(dst []byte, f Frame) []byte {
+	dst, err := c.EncodeFrame(dst, f)
+	if err != nil {
+		panic(err)
+	}
+	return dst
+}
+
+// EncodeFrame appends the header and payload of f to dst, giving the body
+// that Pack wraps. The payload is compressed as described on Codec.Compressor
+// and sealed as described on Codec.AEAD. It fails with ErrSeqExhausted once
+// the AEAD has used all sequence numbers; dst is then returned unchanged.
+func (c *Codec) EncodeFrame(dst []byte, f Frame) ([]byte, error) {
+	f.Flags &^= FlagCompressed
+	if c.Compressor != nil && len(f.Payload) >= c.compressThreshold() {
+		if z, err := c.Compressor.Compress(f.Payload); err == nil && len(z) < len(f.Payload) {
+			f.Flags |= FlagCompressed
+			f.Payload = z
+		}
+	}
+	if c.AEAD != nil {
+		sealed, err := c.AEAD.Seal(f)
+		if err != nil {
+			return dst, err
+		}
+		f = sealed
+	}
+
+	return append(appendFrameHeader(dst, f), f.Payload...), nil
+}
+
+func appendFrameHeader(dst []byte, f Frame) []byte {
+	var h [FrameHeaderLength]byte
+	binary.BigEndian.PutUint16(h[0:], f.Type)
+	binary.BigEndian.PutUint16(h[2:], f.Flags)
+	binary.BigEndian.PutUint32(h[4:], f.Seq)
+	return append(dst, h[:]...)
+}
+
+// ParseFrame parses a body produced by AppendFrame, as returned by Unpack or
+// Decoder.Next. The payload aliases b unless it had to be opened or
+// decompressed.
+func (c *Codec) ParseFrame(b []byte) (Frame, error) {
+	if len(b) < FrameHeaderLength {
+		return Frame{}, ErrShortFrame
+	}
+	f := Frame{
+		Type:    binary.BigEndian.Uint16(b[0:]),
+		Flags:   binary.BigEndian.Uint16(b[2:]),
+		Seq:     binary.BigEndian.Uint32(b[4:]),
+		Payload: b[FrameHeaderLength:],
+	}
+	if c.AEAD != nil {
+		opened, err := c.AEAD.Open(f)
+		if err != nil {
+			return Frame{}, err
+		}
+		f = opened
+	}
+	if f.Flags&FlagCompressed != 0 {
+		if c.Compressor == nil {
+			return Frame{}, ErrCompressed
+		}
+		p, err := c.Compressor.Decompress(f.Payload, c.maxFrameLength())
+		if err != nil {
+			return Frame{}, err
+		}
+		f.Flags &^= FlagCompressed
+		f.Payload = p
+	}
+	return f, nil
+}
+
+// PackFrame returns f framed with c's layout. Like AppendFrame it panics
+// where EncodeFrame would fail.
+func (c *Codec) PackFrame(f Frame) []byte {
+	return c.Pack(c.AppendFrame(make([]byte, 0, FrameHeaderLength+len(f.Payload)), f))
+}
+
+// UnpackFrame works like Unpack but parses every frame with ParseFrame.
+// A frame that ParseFrame rejects stops it with that error.
+func (c *Codec) UnpackFrame(buffer []byte, readerChannel chan Frame) ([]byte, error) {
+	return c.UnpackFunc(buffer, func(data []byte) error {
+		f, err := c.ParseFrame(data)
+		if err != nil {
+			return err
+		}
+		readerChannel <- f
+		return nil
+	})
+}
+
+// NextFrame returns the next frame parsed with ParseFrame.
+// Its payload is only valid until the next call to Next or NextFrame.
+func (d *Decoder) NextFrame() (Frame, error) {
+	data, err := d.Next()
+	if err != nil {
+		return Frame{}, err
+	}
+	return d.codec.ParseFrame(data)
+}
+
+// AppendFrame appends f to dst as DefaultCodec.AppendFrame does.
+func AppendFrame(dst []byte, f Frame) []byte {
+	return DefaultCodec.AppendFrame(dst, f)
+}
+
+// EncodeFrame appends f to dst as DefaultCodec.EncodeFrame does.
+func EncodeFrame(dst []byte, f Frame) ([]byte, error) {
+	return DefaultCodec.EncodeFrame(dst, f)
+}
+
+// ParseFrame parses b as DefaultCodec.ParseFrame does.
+func ParseFrame(b []byte) (Frame, error) {
+	return DefaultCodec.ParseFrame(b)
+}
+
+// PackFrame returns f framed with DefaultCodec.
+func PackFrame(f Frame) []byte {
+	return DefaultCodec.PackFrame(f)
+}
+
+// UnpackFrame unpacks frames in DefaultCodec's layout.
+func UnpackFrame(buffer []byte, readerChannel chan Frame) ([]byte, error) {
+	return DefaultCodec.UnpackFrame(buffer, readerChannel)
+}
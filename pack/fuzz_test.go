@@ -0,0 +1,200 @@
+package pack
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+var fuzzCodecs = []*Codec{
+	DefaultCodec,
+	{LengthSize: 1, MaxFrameLength: 64},
+	{Magic: []byte{0xfe, 0xed}, LengthSize: 2, MaxFrameLength: 1024},
+	{Magic: []byte("M"), LengthSize: LengthUvarint, CRC32: crc32.IEEETable},
+	{Magic: []byte("MAGIC"), LengthSize: 8},
+}
+
+// chunkReader returns its data in the given chunk sizes.
+type chunkReader struct {
+	data   []byte
+	chunks []int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	if len(r.chunks) > 0 {
+		n = r.chunks[0]%len(r.data) + 1
+		r.chunks = r.chunks[1:]
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// unpackStream decodes data with every stateless and stateful API of c,
+// continuing after malformed frames where the codec can resync, and checks
+// they all agree.
+func unpackStream(t *testing.T, c *Codec, data []byte, chunks []int) [][]byte {
+	var frames [][]byte
+	buffer := data
+	for {
+		var got [][]byte
+		var err error
+		got, buffer, err = c.UnpackAll(buffer)
+		for _, f := range got {
+			frames = append(frames, append([]byte{}, f...))
+		}
+		if err == nil || len(c.Magic) == 0 {
+			break
+		}
+	}
+	if len(buffer) > len(data) {
+		t.Fatalf("%+v: %d bytes left from %d", c, len(buffer), len(data))
+	}
+
+	var decoded [][]byte
+	d := c.NewDecoder(&chunkReader{data: data, chunks: chunks})
+	for i := 0; i <= len(data); i++ {
+		f, err := d.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			if len(c.Magic) == 0 {
+				break
+			}
+			continue
+		}
+		decoded = append(decoded, append([]byte{}, f...))
+	}
+	if len(decoded) != len(frames) {
+		t.Fatalf("%+v: Decoder found %d frames, UnpackAll %d", c, len(decoded), len(frames))
+	}
+	for i := range frames {
+		if !bytes.Equal(decoded[i], frames[i]) {
+			t.Fatalf("%+v: frame %d differs", c, i)
+		}
+	}
+	return frames
+}
+
+func FuzzUnpack(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(Pack([]byte("hello")))
+	f.Add(append([]byte(ConstHeader), IntToBytes(-1)...))
+	f.Add(append([]byte("junk"), fuzzCodecs[3].Pack([]byte("crc"))...))
+	f.Add([]byte{0xfe, 0xed, 0xff, 0xff, 0xfe, 0xed, 0, 1, 'x'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, c := range fuzzCodecs {
+			unpackStream(t, c, data, []int{1, 3, 7})
+		}
+	})
+}
+
+func FuzzSplit(f *testing.F) {
+	f.Add([]byte("first"), []byte("second"), uint16(3))
+	f.Fuzz(func(t *testing.T, a, b []byte, seed uint16) {
+		checkSplit(t, [][]byte{a, b}, int64(seed))
+	})
+}
+
+// checkSplit packs messages and checks every codec decodes them back from
+// a stream cut at boundaries chosen by seed.
+func checkSplit(t *testing.T, messages [][]byte, seed int64) bool {
+	rnd := rand.New(rand.NewSource(seed))
+	for _, c := range fuzzCodecs {
+		var stream []byte
+		var want [][]byte
+		for _, m := range messages {
+			if len(m) > c.maxFrameLength() || (c.LengthSize == 1 && len(m) > 0xff) {
+				continue
+			}
+			stream = append(stream, c.Pack(m)...)
+			want = append(want, m)
+		}
+
+		chunks := make([]int, 1+rnd.Intn(len(stream)+1))
+		for i := range chunks {
+			chunks[i] = rnd.Intn(len(stream) + 1)
+		}
+		got := unpackStream(t, c, stream, chunks)
+		if len(got) != len(want) {
+			t.Errorf("%+v: got %d frames, want %d", c, len(got), len(want))
+			return false
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("%+v: frame %d: got %q, want %q", c, i, got[i], want[i])
+				return false
+			}
+		}
+
+		// the same cuts fed through an Unpacker
+		u := c.NewUnpacker()
+		var fed [][]byte
+		rest := stream
+		for _, n := range chunks {
+			if n > len(rest) {
+				n = len(rest)
+			}
+			u.Feed(rest[:n], func(data []byte) error {
+				fed = append(fed, append([]byte{}, data...))
+				return nil
+			})
+			rest = rest[n:]
+		}
+		u.Feed(rest, func(data []byte) error {
+			fed = append(fed, append([]byte{}, data...))
+			return nil
+		})
+		if len(fed) != len(want) || u.Buffered() != 0 {
+			t.Errorf("%+v: Unpacker got %d frames, want %d", c, len(fed), len(want))
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitProperty(t *testing.T) {
+	property := func(messages [][]byte, seed int64) bool {
+		return checkSplit(t, messages, seed)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	stream := bytes.Repeat(Pack(benchMessage), 100)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		UnpackFunc(stream, func([]byte) error { return nil })
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	stream := bytes.Repeat(Pack(benchMessage), 100)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	r := bytes.NewReader(stream)
+	d := NewDecoder(r)
+	for i := 0; i < b.N; i++ {
+		r.Reset(stream)
+		d.Reset(r)
+		for {
+			if _, err := d.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
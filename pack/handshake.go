@@ -0,0 +1,213 @@
+package pack
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Handshake frame types, following the heartbeat types.
+const (
+	TypeHello uint16 = TypePong + 1 + iota
+	TypeHelloAck
+	TypeHandshakeError
+)
+
+// ProtocolVersion is the version of the frame protocol in this package.
+const ProtocolVersion = 1
+
+// Features are optional frame codec features agreed in a handshake.
+type Features uint16
+
+const (
+	FeatureCompression Features = 1 << iota
+	FeatureChecksum
+	FeatureEncryption
+)
+
+var (
+	// ErrVersionMismatch reports that client and server share no protocol
+	// version. The server has sent the client a handshake error frame.
+	ErrVersionMismatch = errors.New("pack: protocol version mismatch")
+	// ErrHandshake reports an unexpected frame during a handshake.
+	ErrHandshake = errors.New("pack: unexpected handshake frame")
+)
+
+// HandshakeError is the reason a peer rejected the handshake.
+type HandshakeError struct {
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return "pack: handshake rejected: " + e.Reason
+}
+
+// HandshakeConfig is what one side of a handshake supports.
+type HandshakeConfig struct {
+	Version    uint16 // highest protocol version, zero means ProtocolVersion
+	MinVersion uint16 // lowest protocol version, zero means Version
+	Features   Features
+	ClientID   string // sent by the client
+	// Compressor is used if FeatureCompression is agreed. Nil means flate.
+	Compressor Compressor
+	// AEAD seals frames if FeatureEncryption is agreed. Without it
+	// FeatureEncryption is not offered.
+	AEAD *AEAD
+}
+
+// Negotiated is the outcome of a handshake.
+type Negotiated struct {
+	Version  uint16
+	Features Features
+	ClientID string
+	// Codec applies the agreed features; the FramedConn already uses it.
+	Codec *Codec
+}
+
+type hello struct {
+	version    uint16
+	minVersion uint16
+	features   Features
+	clientID   string
+}
+
+// ClientHandshake sends a hello on fc and waits for the server's answer.
+// On success fc is switched to the negotiated codec.
+func ClientHandshake(fc *FramedConn, cfg HandshakeConfig) (Negotiated, error) {
+	max, min := cfg.versions()
+	if err := writeHello(fc, TypeHello, hello{max, min, cfg.features(), cfg.ClientID}); err != nil {
+		return Negotiated{}, err
+	}
+
+	f, h, err := readHello(fc)
+	if err != nil {
+		return Negotiated{}, err
+	}
+	switch f.Type {
+	case TypeHelloAck:
+	case TypeHandshakeError:
+		return Negotiated{}, &HandshakeError{Reason: string(f.Payload)}
+	default:
+		return Negotiated{}, ErrHandshake
+	}
+	if h.version < min || h.version > max || h.features&^cfg.features() != 0 {
+		return Negotiated{}, ErrHandshake
+	}
+	return negotiated(fc, cfg, h.version, h.features, cfg.ClientID), nil
+}
+
+// ServerHandshake waits for a client hello on fc and answers with the
+// version and features both sides support, or with a handshake error frame.
+// On success fc is switched to the negotiated codec.
+func ServerHandshake(fc *FramedConn, cfg HandshakeConfig) (Negotiated, error) {
+	f, h, err := readHello(fc)
+	if err != nil {
+		return Negotiated{}, err
+	}
+	if f.Type != TypeHello {
+		return Negotiated{}, ErrHandshake
+	}
+
+	max, min := cfg.versions()
+	version := max
+	if h.version < version {
+		version = h.version
+	}
+	if version < min || version < h.minVersion {
+		reason := fmt.Sprintf("client speaks versions %d-%d, server %d-%d", h.minVersion, h.version, min, max)
+		if err := writeFrame(fc, Frame{Type: TypeHandshakeError, Payload: []byte(reason)}); err != nil {
+			return Negotiated{}, err
+		}
+		return Negotiated{}, ErrVersionMismatch
+	}
+
+	features := cfg.features() & h.features
+	if err := writeHello(fc, TypeHelloAck, hello{version, version, features, ""}); err != nil {
+		return Negotiated{}, err
+	}
+	return negotiated(fc, cfg, version, features, h.clientID), nil
+}
+
+func (cfg HandshakeConfig) versions() (max, min uint16) {
+	max, min = cfg.Version, cfg.MinVersion
+	if max == 0 {
+		max = ProtocolVersion
+	}
+	if min == 0 || min > max {
+		min = max
+	}
+	return max, min
+}
+
+// features returns the features cfg can offer.
+func (cfg HandshakeConfig) features() Features {
+	if cfg.AEAD == nil {
+		return cfg.Features &^ FeatureEncryption
+	}
+	return cfg.Features
+}
+
+// negotiated derives the codec for the agreed features from fc's codec and
+// switches fc to it.
+func negotiated(fc *FramedConn, cfg HandshakeConfig, version uint16, features Features, clientID string) Negotiated {
+	c := *fc.Codec()
+	c.CRC32 = nil
+	if features&FeatureChecksum != 0 {
+		c.CRC32 = crc32.IEEETable
+	}
+	c.Compressor = nil
+	if features&FeatureCompression != 0 {
+		c.Compressor = cfg.Compressor
+		if c.Compressor == nil {
+			c.Compressor, _ = NewFlateCompressor(flate.DefaultCompression)
+		}
+	}
+	c.AEAD = nil
+	if features&FeatureEncryption != 0 {
+		c.AEAD = cfg.AEAD
+	}
+	fc.SetCodec(&c)
+	return Negotiated{Version: version, Features: features, ClientID: clientID, Codec: &c}
+}
+
+func writeHello(fc *FramedConn, typ uint16, h hello) error {
+	w := NewFieldWriter(nil)
+	w.WriteUint16(h.version)
+	w.WriteUint16(h.minVersion)
+	w.WriteUint16(uint16(h.features))
+	w.WriteString(h.clientID)
+	return writeFrame(fc, Frame{Type: typ, Payload: w.Bytes()})
+}
+
+// readHello reads the next frame and, if it is a hello or its answer,
+// decodes the payload.
+func readHello(fc *FramedConn) (Frame, hello, error) {
+	data, err := fc.ReadFrame()
+	if err != nil {
+		return Frame{}, hello{}, err
+	}
+	f, err := fc.codec.ParseFrame(data)
+	if err != nil {
+		return Frame{}, hello{}, err
+	}
+	if f.Type != TypeHello && f.Type != TypeHelloAck {
+		return f, hello{}, nil
+	}
+
+	var h hello
+	var features uint16
+	r := NewFieldReader(f.Payload, nil)
+	if h.version, err = r.ReadUint16(); err == nil {
+		if h.minVersion, err = r.ReadUint16(); err == nil {
+			if features, err = r.ReadUint16(); err == nil {
+				h.clientID, err = r.ReadString()
+			}
+		}
+	}
+	if err != nil {
+		return f, hello{}, ErrHandshake
+	}
+	h.features = Features(features)
+	return f, h, nil
+}
@@ -0,0 +1,127 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Heartbeat frame types. A ping carries the sender's clock, which the pong
+// echoes back.
+const (
+	TypePing uint16 = TypeReserved + iota
+	TypePong
+)
+
+// ErrIdleTimeout reports a peer that sent nothing for the idle timeout.
+var ErrIdleTimeout = errors.New("pack: peer idle timeout")
+
+// Keepalive exchanges heartbeats over a FramedConn carrying frames with the
+// extended header. It answers and filters heartbeat frames in ReadFrame, so
+// the application never sees them, and drops peers that fall silent.
+type Keepalive struct {
+	fc *FramedConn
+
+	mu  sync.Mutex
+	rtt time.Duration
+
+	pongs     chan Frame // written by the pinger so reading never blocks on writes
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKeepalive starts sending a ping every interval on fc. ReadFrame fails
+// with ErrIdleTimeout and closes fc if nothing arrives for idleTimeout,
+// which should span a few intervals.
+func NewKeepalive(fc *FramedConn, interval, idleTimeout time.Duration) *Keepalive {
+	ka := &Keepalive{
+		fc:    fc,
+		pongs: make(chan Frame, 1),
+		done:  make(chan struct{}),
+	}
+	fc.SetReadTimeout(idleTimeout)
+	go ka.pinger(interval)
+	return ka
+}
+
+// ReadFrame returns the next application frame. Its payload is only valid
+// until the next call.
+func (ka *Keepalive) ReadFrame() (Frame, error) {
+	for {
+		data, err := ka.fc.ReadFrame()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			ka.Close()
+			return Frame{}, ErrIdleTimeout
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		f, err := ka.fc.codec.ParseFrame(data)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		switch f.Type {
+		case TypePing:
+			pong := Frame{Type: TypePong, Payload: append([]byte{}, f.Payload...)}
+			select {
+			case ka.pongs <- pong:
+			default:
+				// a pong is still pending; the peer can do with one
+			}
+		case TypePong:
+			if len(f.Payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(f.Payload)))
+				ka.mu.Lock()
+				ka.rtt = time.Since(sent)
+				ka.mu.Unlock()
+			}
+		default:
+			return f, nil
+		}
+	}
+}
+
+// WriteFrame sends f.
+func (ka *Keepalive) WriteFrame(f Frame) error {
+	return writeFrame(ka.fc, f)
+}
+
+// RTT returns the round trip time measured by the last pong, or zero.
+func (ka *Keepalive) RTT() time.Duration {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	return ka.rtt
+}
+
+// Close stops the heartbeats and closes the FramedConn.
+func (ka *Keepalive) Close() error {
+	err := ErrClosed
+	ka.closeOnce.Do(func() {
+		close(ka.done)
+		err = ka.fc.Close()
+	})
+	return err
+}
+
+func (ka *Keepalive) pinger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var f Frame
+		select {
+		case <-ka.done:
+			return
+		case f = <-ka.pongs:
+		case <-ticker.C:
+			var now [8]byte
+			binary.BigEndian.PutUint64(now[:], uint64(time.Now().UnixNano()))
+			f = Frame{Type: TypePing, Payload: now[:]}
+		}
+		if err := ka.WriteFrame(f); err != nil {
+			return
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package pack
 
 import (
-	"bytes"
 	"encoding/binary"
+	"io"
 )
 
 const (
@@ -13,51 +13,45 @@ const (
 
 //封包
 func Pack(message []byte) []byte {
-	return append(append([]byte(ConstHeader), IntToBytes(len(message))...), message...)
+	return DefaultCodec.Pack(message)
+}
+
+// AppendPack appends the framed message to dst and returns the extended slice.
+func AppendPack(dst, message []byte) []byte {
+	return DefaultCodec.AppendPack(dst, message)
+}
+
+// WriteTo writes the framed message to w without copying the payload.
+func WriteTo(w io.Writer, message []byte) (int64, error) {
+	return DefaultCodec.WriteTo(w, message)
 }
 
 //解包
-func Unpack(buffer []byte, readerChannel chan []byte) []byte {
-	length := len(buffer)
-
-	var i int
-	for i = 0; i < length; i = i + 1 {
-		if length < i + ConstHeaderLength + ConstSaveDataLength {
-			break
-		}
-		if string(buffer[i:i + ConstHeaderLength]) == ConstHeader {
-			messageLength := BytesToInt(buffer[i + ConstHeaderLength : i + ConstHeaderLength + ConstSaveDataLength])
-			if length < i + ConstHeaderLength + ConstSaveDataLength + messageLength {
-				break
-			}
-			data := buffer[i + ConstHeaderLength + ConstSaveDataLength : i + ConstHeaderLength + ConstSaveDataLength + messageLength]
-			readerChannel <- data
-
-			i += ConstHeaderLength + ConstSaveDataLength + messageLength - 1
-		}
-	}
+func Unpack(buffer []byte, readerChannel chan []byte) ([]byte, error) {
+	return DefaultCodec.Unpack(buffer, readerChannel)
+}
 
-	if i == length {
-		return make([]byte, 0)
-	}
-	return buffer[i:]
+// UnpackFunc calls fn for every complete frame in buffer, see Codec.UnpackFunc.
+func UnpackFunc(buffer []byte, fn func([]byte) error) ([]byte, error) {
+	return DefaultCodec.UnpackFunc(buffer, fn)
+}
+
+// UnpackAll returns all complete frames in buffer, see Codec.UnpackAll.
+func UnpackAll(buffer []byte) ([][]byte, []byte, error) {
+	return DefaultCodec.UnpackAll(buffer)
 }
 
 //整形转换成字节
 func IntToBytes(n int) []byte {
-	x := int32(n)
-
-	bytesBuffer := bytes.NewBuffer([]byte{})
-	binary.Write(bytesBuffer, binary.BigEndian, x)
-	return bytesBuffer.Bytes()
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(n)))
+	return b
 }
 
 //字节转换成整形
 func BytesToInt(b []byte) int {
-	bytesBuffer := bytes.NewBuffer(b)
-
-	var x int32
-	binary.Read(bytesBuffer, binary.BigEndian, &x)
-
-	return int(x)
-}
\ No newline at end of file
+	if len(b) < 4 {
+		return 0
+	}
+	return int(int32(binary.BigEndian.Uint32(b)))
+}
@@ -1,54 +1,572 @@
 package pack
 
 import (
-	"net"
-	"testing"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"testing/iotest"
 )
 
-func sender(writer io.Writer) {
+const words = "{\"Id\":1,\"Name\":\"golang\",\"Message\":\"message\"}"
+
+func sender(writer io.WriteCloser) {
+	defer writer.Close()
 	for i := 0; i < 50; i++ {
-		words := "{\"Id\":1,\"Name\":\"golang\",\"Message\":\"message\"}"
+		if i%10 == 0 {
+			// garbage and a header with a negative length between frames
+			writer.Write([]byte("garbage"))
+			writer.Write(append([]byte(ConstHeader), IntToBytes(-1)...))
+		}
 		writer.Write(Pack([]byte(words)))
 	}
-	fmt.Println("send over")
 }
 
-func handleReader(reader io.Reader) {
+func handleReader(reader io.Reader) ([]string, error) {
 	tmpBuffer := make([]byte, 0)
 
-	readCh := make(chan []byte, 16)
-	go func(readCh chan []byte) {
-		for {
-			select {
-			case data := <-readCh:
-				fmt.Println("read data: ", string(data))
-			}
-		}
-	}(readCh)
-
+	var received []string
+	readCh := make(chan []byte, 64)
 	buffer := make([]byte, 1024)
 	for {
 		n, err := reader.Read(buffer)
+		if err == io.EOF {
+			return received, nil
+		}
 		if err != nil {
-			fmt.Println("read error: ", err)
+			return received, err
+		}
+		tmpBuffer = append(tmpBuffer, buffer[:n]...)
+		for {
+			tmpBuffer, err = Unpack(tmpBuffer, readCh)
+			for len(readCh) > 0 {
+				received = append(received, string(<-readCh))
+			}
+			if err == nil {
+				break
+			}
+			if err != ErrBadLength {
+				return received, err
+			}
 		}
-		fmt.Println("reader bytes: ", buffer[:n])
-		tmpBuffer = Unpack(append(tmpBuffer, buffer[:n] ...), readCh)
 	}
 }
 
 func TestMalformedInput(t *testing.T) {
 	cli, srv := net.Pipe()
-	//go cli.Write([]byte(`{id:1}`)) // invalid json
-	//jsonrpc.ServeConn(srv)                 // must return, not loop
+	go sender(cli)
+
+	received, err := handleReader(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 50 {
+		t.Fatalf("got %d frames, want 50", len(received))
+	}
+	for _, data := range received {
+		if data != words {
+			t.Fatalf("got %q", data)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var stream []byte
+	stream = append(stream, "junk"...)
+	for i := 0; i < 100; i++ {
+		stream = append(stream, Pack([]byte(fmt.Sprintf("message %d", i)))...)
+	}
+	stream = append(stream, Pack(nil)...)
+
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream)))
+	for i := 0; i < 100; i++ {
+		data, err := d.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("message %d", i); string(data) != want {
+			t.Fatalf("frame %d: got %q, want %q", i, data, want)
+		}
+	}
+	if data, err := d.Next(); err != nil || len(data) != 0 {
+		t.Fatalf("empty frame: got %q, %v", data, err)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	frame := Pack([]byte("truncated"))
+	d := NewDecoder(bytes.NewReader(frame[:len(frame)-1]))
+	if _, err := d.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	frame := Pack([]byte("reset"))
+	d := NewDecoder(bytes.NewReader(frame[:3]))
+	if _, err := d.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+	d.Reset(bytes.NewReader(frame))
+	if data, err := d.Next(); err != nil || string(data) != "reset" {
+		t.Fatalf("after Reset: got %q, %v", data, err)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	codecs := []*Codec{
+		DefaultCodec,
+		{LengthSize: 1},
+		{Magic: []byte{0xfe, 0xed}, LengthSize: 2},
+		{Magic: []byte{0xfe, 0xed}, LengthSize: 2, ByteOrder: binary.LittleEndian},
+		{Magic: []byte("M"), LengthSize: 8},
+		{Magic: []byte("MAGIC"), LengthSize: LengthUvarint},
+		{Magic: []byte("M"), LengthSize: 4, CRC32: crc32.MakeTable(crc32.Castagnoli)},
+	}
+	messages := []string{"", "a", "hello world", string(make([]byte, 200))}
+
+	for _, c := range codecs {
+		var stream []byte
+		for _, m := range messages {
+			stream = append(stream, c.Pack([]byte(m))...)
+		}
+		d := c.NewDecoder(iotest.HalfReader(bytes.NewReader(stream)))
+		for i, m := range messages {
+			data, err := d.Next()
+			if err != nil {
+				t.Fatalf("%+v frame %d: %v", c, i, err)
+			}
+			if string(data) != m {
+				t.Fatalf("%+v frame %d: got %q, want %q", c, i, data, m)
+			}
+		}
+		if _, err := d.Next(); err != io.EOF {
+			t.Fatalf("%+v: got %v, want io.EOF", c, err)
+		}
+	}
+
+	c := &Codec{Magic: []byte{0xfe, 0xed}, LengthSize: 2}
+	if got := c.Pack([]byte("abc")); !bytes.Equal(got, []byte{0xfe, 0xed, 0, 3, 'a', 'b', 'c'}) {
+		t.Fatalf("got % x", got)
+	}
+}
+
+func TestMalformedLength(t *testing.T) {
+	bad := append([]byte(ConstHeader), IntToBytes(-1)...)
+	good := Pack([]byte("good"))
+	stream := append(append(bad, "junk"...), good...)
+
+	readCh := make(chan []byte, 1)
+	rest, err := Unpack(stream, readCh)
+	if err != ErrBadLength {
+		t.Fatalf("got %v, want ErrBadLength", err)
+	}
+	if rest, err = Unpack(rest, readCh); err != nil || len(rest) != 0 {
+		t.Fatalf("resync: got %q, %v", rest, err)
+	}
+	if data := <-readCh; string(data) != "good" {
+		t.Fatalf("got %q after resync", data)
+	}
+
+	c := &Codec{Magic: []byte{0xfe, 0xed}, LengthSize: 4, MaxFrameLength: 8}
+	d := c.NewDecoder(bytes.NewReader(append(c.Pack(make([]byte, 9)), c.Pack([]byte("ok"))...)))
+	if _, err := d.Next(); err != ErrFrameTooLarge {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+	if data, err := d.Next(); err != nil || string(data) != "ok" {
+		t.Fatalf("resync: got %q, %v", data, err)
+	}
+
+	c = &Codec{LengthSize: 4, MaxFrameLength: 8}
+	d = c.NewDecoder(bytes.NewReader(c.Pack(make([]byte, 1<<20))))
+	for i := 0; i < 2; i++ {
+		if _, err := d.Next(); err != ErrFrameTooLarge {
+			t.Fatalf("got %v, want ErrFrameTooLarge", err)
+		}
+	}
+	if len(d.buf) > defaultDecoderBufferSize {
+		t.Fatalf("decoder buffered %d bytes", len(d.buf))
+	}
+
+	// only a 4 byte field is read as an int32; wider ones obey MaxFrameLength
+	for _, c := range []*Codec{
+		{Magic: []byte("M"), LengthSize: 8, MaxFrameLength: -1},
+		{Magic: []byte("M"), LengthSize: LengthUvarint, MaxFrameLength: -1},
+	} {
+		header := c.appendLength([]byte("M"), 1<<31)
+		if _, rest, err := c.UnpackAll(header); err != nil || len(rest) != len(header) {
+			t.Fatalf("LengthSize %d: got %v with %d bytes left, want an incomplete frame", c.LengthSize, err, len(rest))
+		}
+	}
+	huge := append([]byte("M"), 0x80, 0, 0, 0, 0, 0, 0, 0)
+	c = &Codec{Magic: []byte("M"), LengthSize: 8, MaxFrameLength: -1}
+	if _, _, err := c.UnpackAll(huge); err != ErrFrameTooLarge {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	c := &Codec{Magic: []byte{0xfe, 0xed}, LengthSize: 2, CRC32: crc32.IEEETable}
+	corrupt := c.Pack([]byte("hello"))
+	corrupt[len(corrupt)-6] ^= 0x01
+	stream := append(append(c.Pack([]byte("first")), corrupt...), c.Pack([]byte("last"))...)
+
+	d := c.NewDecoder(bytes.NewReader(stream))
+	for _, want := range []string{"first", "", "last"} {
+		data, err := d.Next()
+		if want == "" {
+			if err != ErrChecksum {
+				t.Fatalf("got %q, %v, want ErrChecksum", data, err)
+			}
+			continue
+		}
+		if err != nil || string(data) != want {
+			t.Fatalf("got %q, %v, want %q", data, err, want)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	frames := []Frame{
+		{Type: 1, Seq: 1, Payload: []byte("move")},
+		{Type: 0xfeff, Flags: 0x8001, Seq: 0xffffffff},
+	}
+	var stream []byte
+	for _, f := range frames {
+		stream = append(stream, PackFrame(f)...)
+	}
+	stream = append(stream, Pack([]byte("short"))...)
+
+	readCh := make(chan Frame, len(frames))
+	rest, err := UnpackFrame(stream, readCh)
+	if err != ErrShortFrame || len(rest) != 0 {
+		t.Fatalf("got %q, %v, want ErrShortFrame", rest, err)
+	}
+	for _, want := range frames {
+		got := <-readCh
+		// a caller's FlagCompressed is cleared, not misread as compression
+		want.Flags &^= FlagCompressed
+		if got.Type != want.Type || got.Flags != want.Flags || got.Seq != want.Seq || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	flateC, _ := NewFlateCompressor(flate.BestSpeed)
+	gzipC, _ := NewGzipCompressor(gzip.DefaultCompression)
+	snapshot := bytes.Repeat([]byte("inventory "), 1000)
+
+	for _, z := range []Compressor{flateC, gzipC} {
+		c := &Codec{Magic: []byte{0xfe, 0xed}, LengthSize: 4, Compressor: z, CompressThreshold: 64}
+		big := c.PackFrame(Frame{Type: 1, Payload: snapshot})
+		small := c.PackFrame(Frame{Type: 2, Payload: []byte("move")})
+		if len(big) >= len(snapshot) {
+			t.Fatalf("%T: snapshot not compressed", z)
+		}
+		if !bytes.Contains(small, []byte("move")) {
+			t.Fatalf("%T: small frame compressed", z)
+		}
+
+		d := c.NewDecoder(bytes.NewReader(append(big, small...)))
+		for _, want := range []Frame{{Type: 1, Payload: snapshot}, {Type: 2, Payload: []byte("move")}} {
+			f, err := d.NextFrame()
+			if err != nil || f.Type != want.Type || f.Flags != 0 || !bytes.Equal(f.Payload, want.Payload) {
+				t.Fatalf("%T: got %+v, %v", z, f.Type, err)
+			}
+		}
+
+		limited := &Codec{Magic: c.Magic, LengthSize: 4, Compressor: z, MaxFrameLength: 1000}
+		if _, err := limited.NewDecoder(bytes.NewReader(big)).NextFrame(); err != ErrFrameTooLarge {
+			t.Fatalf("%T: got %v, want ErrFrameTooLarge", z, err)
+		}
+		if _, err := (&Codec{Magic: c.Magic, LengthSize: 4}).NewDecoder(bytes.NewReader(big)).NextFrame(); err != ErrCompressed {
+			t.Fatalf("%T: got %v, want ErrCompressed", z, err)
+		}
+	}
+}
+
+func TestAppendPack(t *testing.T) {
+	for _, c := range []*Codec{DefaultCodec, {Magic: []byte{0xfe}, LengthSize: 2, CRC32: crc32.IEEETable}} {
+		msg := []byte("hello")
+		dst := c.AppendPack([]byte("prefix"), msg)
+		if want := append([]byte("prefix"), c.Pack(msg)...); !bytes.Equal(dst, want) {
+			t.Fatalf("AppendPack: got % x, want % x", dst, want)
+		}
+		var buf bytes.Buffer
+		if n, err := c.WriteTo(&buf, msg); err != nil || int(n) != buf.Len() || !bytes.Equal(buf.Bytes(), c.Pack(msg)) {
+			t.Fatalf("WriteTo: got % x, %d, %v", buf.Bytes(), n, err)
+		}
+
+		dst = make([]byte, 0, 64)
+		if n := testing.AllocsPerRun(100, func() { c.AppendPack(dst, msg) }); n != 0 {
+			t.Fatalf("AppendPack: %v allocations", n)
+		}
+		if n := testing.AllocsPerRun(100, func() { c.WriteTo(ioutil.Discard, msg) }); n != 0 {
+			t.Fatalf("WriteTo: %v allocations", n)
+		}
+	}
+	for _, n := range []int{0, 1, -1, 1 << 30, -1 << 31} {
+		if got := BytesToInt(IntToBytes(n)); got != n {
+			t.Fatalf("BytesToInt(IntToBytes(%d)) = %d", n, got)
+		}
+		if !bytes.Equal(IntToBytes(n), legacyIntToBytes(n)) {
+			t.Fatalf("IntToBytes(%d) differs from legacy", n)
+		}
+	}
+}
+
+// legacyIntToBytes and legacyPack are the original implementations, kept as
+// a baseline for the benchmarks.
+func legacyIntToBytes(n int) []byte {
+	x := int32(n)
+	bytesBuffer := bytes.NewBuffer([]byte{})
+	binary.Write(bytesBuffer, binary.BigEndian, x)
+	return bytesBuffer.Bytes()
+}
+
+func legacyPack(message []byte) []byte {
+	return append(append([]byte(ConstHeader), legacyIntToBytes(len(message))...), message...)
+}
+
+var benchMessage = bytes.Repeat([]byte("x"), 128)
+
+func BenchmarkLegacyPack(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyPack(benchMessage)
+	}
+}
+
+func BenchmarkPack(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Pack(benchMessage)
+	}
+}
+
+func BenchmarkAppendPack(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 1024)
+	for i := 0; i < b.N; i++ {
+		buf = AppendPack(buf[:0], benchMessage)
+	}
+}
 
-	go sender(cli);
+func BenchmarkWriteTo(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteTo(ioutil.Discard, benchMessage)
+	}
+}
 
-	handleReader(srv);
+func BenchmarkLegacyIntToBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyIntToBytes(i)
+	}
+}
 
-	endless := make(chan interface{}, 0)
+func BenchmarkIntToBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		IntToBytes(i)
+	}
+}
+
+func TestUnpackFunc(t *testing.T) {
+	var stream []byte
+	for _, m := range []string{"a", "b", "c"} {
+		stream = append(stream, Pack([]byte(m))...)
+	}
+	partial := Pack([]byte("partial"))
+	stream = append(stream, partial[:10]...)
+
+	frames, rest, err := UnpackAll(stream)
+	if err != nil || len(frames) != 3 || string(frames[2]) != "c" || !bytes.Equal(rest, partial[:10]) {
+		t.Fatalf("UnpackAll: got %q, %q, %v", frames, rest, err)
+	}
+
+	stop := errors.New("stop")
+	var got []string
+	rest, err = UnpackFunc(stream, func(data []byte) error {
+		got = append(got, string(data))
+		if len(got) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(got) != 2 {
+		t.Fatalf("UnpackFunc: got %q, %v", got, err)
+	}
+	if frames, _, _ := UnpackAll(rest); len(frames) != 1 || string(frames[0]) != "c" {
+		t.Fatalf("UnpackFunc rest: got %q", frames)
+	}
+}
 
-	<- endless
+func TestStats(t *testing.T) {
+	var stream []byte
+	stream = append(stream, Pack([]byte("a"))...)
+	stream = append(stream, "garbage"...)
+	stream = append(stream, Pack([]byte("b"))...)
+	stream = append(stream, ConstHeader[:5]...)
+	stream = append(stream, Pack([]byte("c"))...)
+
+	u := NewUnpacker()
+	var got []string
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if err := u.Feed(stream[i:end], func(data []byte) error {
+			got = append(got, string(data))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(got) != "[a b c]" || u.Buffered() != 0 {
+		t.Fatalf("got %q, %d bytes buffered", got, u.Buffered())
+	}
+	want := Stats{Frames: 3, Bytes: uint64(len(stream)), Skipped: 12, Resyncs: 2}
+	if s := u.Stats(); s != want {
+		t.Fatalf("got %+v, want %+v", s, want)
+	}
+
+	d := NewDecoder(bytes.NewReader(stream))
+	d.SetMaxResyncs(1)
+	for _, want := range []string{"a", "b"} {
+		if data, err := d.Next(); err != nil || string(data) != want {
+			t.Fatalf("got %q, %v, want %q", data, err, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Next(); err != ErrTooManyResyncs {
+			t.Fatalf("got %v, want ErrTooManyResyncs", err)
+		}
+	}
+}
+
+type testLogin struct {
+	Player string
+	Level  int
+}
+
+type testMove struct {
+	X, Y float64
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(1, (*testLogin)(nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(2, testMove{}, Gob); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(1, "", nil); err != ErrDuplicate {
+		t.Fatalf("duplicate id: got %v", err)
+	}
+	if err := r.Register(3, testMove{}, nil); err != ErrDuplicate {
+		t.Fatalf("duplicate type: got %v", err)
+	}
+	if err := r.Register(TypeReserved, 0, nil); err != ErrReservedType {
+		t.Fatalf("reserved id: got %v", err)
+	}
+	if err := r.Register(9, nil, nil); err != ErrNilType {
+		t.Fatalf("nil value: got %v", err)
+	}
+
+	var stream []byte
+	for _, v := range []interface{}{&testLogin{"lkj", 3}, testLogin{"abc", 1}, &testMove{1.5, -2}} {
+		body, err := r.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, Pack(body)...)
+	}
+	if _, err := r.Encode(42); err != ErrNotRegistered {
+		t.Fatalf("unregistered value: got %v", err)
+	}
+
+	d := NewDecoder(bytes.NewReader(stream))
+	for _, want := range []interface{}{&testLogin{"lkj", 3}, &testLogin{"abc", 1}, testMove{1.5, -2}} {
+		data, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := r.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%#v", v) != fmt.Sprintf("%#v", want) {
+			t.Fatalf("got %#v, want %#v", v, want)
+		}
+	}
+	if _, err := r.DecodeFrame(Frame{Type: 9}); err != ErrNotRegistered {
+		t.Fatalf("unknown id: got %v", err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, order := range []binary.ByteOrder{nil, binary.LittleEndian} {
+		w := NewFieldWriter(order)
+		w.WriteUint8(0xab)
+		w.WriteInt16(-2)
+		w.WriteUint32(0xdeadbeef)
+		w.WriteInt64(-1 << 40)
+		w.WriteFloat32(1.5)
+		w.WriteFloat64(-0.25)
+		w.WriteBool(true)
+		w.WriteVarint(-3)
+		w.WriteUvarint(300)
+		w.WriteString("player")
+		w.WriteBytes([]byte{1, 2})
+
+		r := NewFieldReader(w.Bytes(), order)
+		u8, _ := r.ReadUint8()
+		i16, _ := r.ReadInt16()
+		u32, _ := r.ReadUint32()
+		i64, _ := r.ReadInt64()
+		f32, _ := r.ReadFloat32()
+		f64, _ := r.ReadFloat64()
+		b, _ := r.ReadBool()
+		v, _ := r.ReadVarint()
+		uv, _ := r.ReadUvarint()
+		s, _ := r.ReadString()
+		bs, err := r.ReadBytes()
+		got := fmt.Sprintln(u8, i16, u32, i64, f32, f64, b, v, uv, s, bs, err, r.Len())
+		if want := "171 -2 3735928559 -1099511627776 1.5 -0.25 true -3 300 player [1 2] <nil> 0\n"; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+
+	r := NewFieldReader([]byte{5, 'a', 'b'}, nil)
+	if _, err := r.ReadString(); err != io.ErrUnexpectedEOF || r.Len() != 3 {
+		t.Fatalf("short string: got %v, %d left", err, r.Len())
+	}
+	if _, err := r.ReadUint32(); err != io.ErrUnexpectedEOF || r.Len() != 3 {
+		t.Fatalf("short uint32: got %v, %d left", err, r.Len())
+	}
+	r = NewFieldReader(bytes.Repeat([]byte{0xff}, 11), nil)
+	if _, err := r.ReadUvarint(); err != ErrBadVarint {
+		t.Fatalf("overflow: got %v", err)
+	}
 }
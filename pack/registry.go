@@ -0,0 +1,171 @@
+package pack
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrNotRegistered reports a value or frame type unknown to a Registry.
+	ErrNotRegistered = errors.New("pack: type not registered")
+	// ErrDuplicate reports a Go type or message ID registered twice.
+	ErrDuplicate = errors.New("pack: type already registered")
+	// ErrReservedType reports a message ID of TypeReserved or above.
+	ErrReservedType = errors.New("pack: reserved frame type")
+	// ErrNilType reports a Register call with a nil sample value.
+	ErrNilType = errors.New("pack: cannot register nil")
+)
+
+// Marshaler turns registered values into frame payloads and back.
+// Protobuf or other formats can be plugged in by implementing it.
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON marshals with encoding/json.
+	JSON Marshaler = jsonMarshaler{}
+	// Gob marshals with encoding/gob. Every frame carries its own type
+	// description, so it suits rare or large messages best.
+	Gob Marshaler = gobMarshaler{}
+)
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobMarshaler struct{}
+
+func (gobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type registration struct {
+	id        uint16
+	typ       reflect.Type // without pointer
+	pointer   bool         // registered as *typ
+	marshaler Marshaler
+}
+
+// Registry maps Go types to message IDs, which travel as the Frame type.
+type Registry struct {
+	codec *Codec
+
+	mu     sync.RWMutex
+	byType map[reflect.Type]*registration
+	byID   map[uint16]*registration
+}
+
+// NewRegistry returns an empty Registry producing frames for DefaultCodec.
+func NewRegistry() *Registry {
+	return DefaultCodec.NewRegistry()
+}
+
+// NewRegistry returns an empty Registry producing frames for c.
+func (c *Codec) NewRegistry() *Registry {
+	return &Registry{
+		codec:  c,
+		byType: make(map[reflect.Type]*registration),
+		byID:   make(map[uint16]*registration),
+	}
+}
+
+// Register binds the type of v to message id, marshaled with m, or JSON if m
+// is nil. If v is a pointer, Decode returns pointers, otherwise values.
+func (r *Registry) Register(id uint16, v interface{}, m Marshaler) error {
+	if id >= TypeReserved {
+		return ErrReservedType
+	}
+	if v == nil {
+		return ErrNilType
+	}
+	if m == nil {
+		m = JSON
+	}
+	reg := &registration{id: id, typ: reflect.TypeOf(v), marshaler: m}
+	if reg.typ.Kind() == reflect.Ptr {
+		reg.typ = reg.typ.Elem()
+		reg.pointer = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byID[id]; ok {
+		return ErrDuplicate
+	}
+	if _, ok := r.byType[reg.typ]; ok {
+		return ErrDuplicate
+	}
+	r.byID[id] = reg
+	r.byType[reg.typ] = reg
+	return nil
+}
+
+// Encode marshals v into a frame body typed with its message ID, ready for
+// Pack or FramedConn.WriteFrame. v may be a registered type or a pointer to it.
+func (r *Registry) Encode(v interface{}) ([]byte, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.mu.RLock()
+	reg, ok := r.byType[t]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+
+	payload, err := reg.marshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return r.codec.EncodeFrame(nil, Frame{Type: reg.id, Payload: payload})
+}
+
+// Decode parses a frame body produced by Encode and returns a new value of
+// the registered type.
+func (r *Registry) Decode(b []byte) (interface{}, error) {
+	f, err := r.codec.ParseFrame(b)
+	if err != nil {
+		return nil, err
+	}
+	return r.DecodeFrame(f)
+}
+
+// DecodeFrame unmarshals the payload of f according to its type.
+func (r *Registry) DecodeFrame(f Frame) (interface{}, error) {
+	r.mu.RLock()
+	reg, ok := r.byID[f.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+
+	v := reflect.New(reg.typ)
+	if err := reg.marshaler.Unmarshal(f.Payload, v.Interface()); err != nil {
+		return nil, err
+	}
+	if reg.pointer {
+		return v.Interface(), nil
+	}
+	return v.Elem().Interface(), nil
+}
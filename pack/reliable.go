@@ -0,0 +1,604 @@
+package pack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FlagAck marks an acknowledgement sent by a ReliableConn.
+const FlagAck uint16 = 1 << 13
+
+// FlagFin marks the packet a ReliableConn sends on Close, after all its
+// data was acknowledged.
+const FlagFin uint16 = 1 << 12
+
+// StreamChannel is the ReliableConn channel carrying the Read/Write stream.
+const StreamChannel uint16 = 0
+
+// DefaultMTU is the largest datagram a ReliableConn sends.
+const DefaultMTU = 1200
+
+// MaxChannels is the number of channels a ReliableConn accepts from its
+// peer. Packets opening further channels are dropped unacknowledged.
+const MaxChannels = 64
+
+const (
+	reliableWindow  = 256 // unacknowledged packets per connection
+	maxRetries      = 20
+	initialRTO      = 200 * time.Millisecond
+	minRTO          = 20 * time.Millisecond
+	maxRTO          = 2 * time.Second
+	resendInterval  = 10 * time.Millisecond
+	maxStreamBuffer = 256 << 10
+	maxMessageQueue = 1024
+)
+
+var (
+	// ErrPeerTimeout reports a peer that stopped acknowledging packets.
+	ErrPeerTimeout = errors.New("pack: peer not responding")
+	// ErrStreamChannel reports a Send on StreamChannel, which belongs to
+	// Read and Write.
+	ErrStreamChannel = errors.New("pack: channel 0 is the stream channel")
+
+	errTimeout net.Error = timeoutError{}
+)
+
+// timeoutError is returned when a ReliableConn deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "pack: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type reliableChannel struct {
+	sendSeq  uint32
+	recvNext uint32
+	pending  map[uint32][]byte // received but not yet delivered
+}
+
+type inflightKey struct {
+	channel uint16
+	seq     uint32
+}
+
+type inflightPacket struct {
+	datagram []byte
+	sent     time.Time
+	retries  int
+}
+
+type reliableMessage struct {
+	channel uint16
+	data    []byte
+}
+
+// ReliableConn is a reliable connection to one peer over a PacketConn.
+// Every datagram is a frame body whose Type is the channel and whose Seq
+// numbers packets within it. Packets are acknowledged and resent with an
+// RTT based timeout, and delivered in order per channel.
+//
+// Channel StreamChannel carries a byte stream, so a ReliableConn is a
+// net.Conn and FramedConn can run on it unchanged. The other channels carry
+// messages through Send and Recv. Once the peer has closed, Read returns
+// io.EOF and Recv ErrClosed after everything it sent was read.
+type ReliableConn struct {
+	codec *Codec
+	pc    net.PacketConn
+	raddr net.Addr
+
+	mu            sync.Mutex
+	channels      map[uint16]*reliableChannel
+	inflight      map[inflightKey]*inflightPacket
+	srtt          time.Duration
+	rttvar        time.Duration
+	rto           time.Duration
+	stream        []byte
+	messages      []reliableMessage
+	err           error
+	closing       bool // Close is waiting for the peer's acknowledgements
+	peerClosed    bool // the peer sent FlagFin
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	streamReady  chan struct{}
+	messageReady chan struct{}
+	writable     chan struct{}
+	finAcked     chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewReliableConn returns a ReliableConn using DefaultCodec.
+func NewReliableConn(pc net.PacketConn, raddr net.Addr) *ReliableConn {
+	return DefaultCodec.NewReliableConn(pc, raddr)
+}
+
+// NewReliableConn returns a ReliableConn talking to raddr over pc, using c
+// to encode frame bodies. It takes ownership of pc and ignores datagrams
+// from other addresses.
+func (c *Codec) NewReliableConn(pc net.PacketConn, raddr net.Addr) *ReliableConn {
+	rc := &ReliableConn{
+		codec:        c,
+		pc:           pc,
+		raddr:        raddr,
+		channels:     make(map[uint16]*reliableChannel),
+		inflight:     make(map[inflightKey]*inflightPacket),
+		rto:          initialRTO,
+		streamReady:  make(chan struct{}, 1),
+		messageReady: make(chan struct{}, 1),
+		writable:     make(chan struct{}, 1),
+		finAcked:     make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	go rc.receiver()
+	go rc.resender()
+	return rc
+}
+
+// Read reads from the stream channel.
+func (rc *ReliableConn) Read(b []byte) (int, error) {
+	for {
+		rc.mu.Lock()
+		if len(rc.stream) > 0 {
+			n := copy(b, rc.stream)
+			rc.stream = append(rc.stream[:0], rc.stream[n:]...)
+			rc.deliver()
+			rc.mu.Unlock()
+			return n, nil
+		}
+		err, deadline := rc.err, rc.readDeadline
+		if err == nil && rc.peerClosed && rc.drained(true) {
+			err = io.EOF
+		}
+		rc.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err := rc.wait(rc.streamReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes b to the stream channel in packets of up to DefaultMTU.
+// It blocks while too many packets are unacknowledged.
+func (rc *ReliableConn) Write(b []byte) (int, error) {
+	chunk := rc.maxPayload()
+	n := 0
+	for n < len(b) {
+		end := n + chunk
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := rc.send(StreamChannel, b[n:end]); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// Send sends message on channel, which must not be StreamChannel. The
+// message must fit in one datagram.
+func (rc *ReliableConn) Send(channel uint16, message []byte) error {
+	if channel == StreamChannel {
+		return ErrStreamChannel
+	}
+	if len(message) > rc.maxPayload() {
+		return ErrMessageTooLarge
+	}
+	return rc.send(channel, message)
+}
+
+// Recv returns the next message from any channel but StreamChannel.
+func (rc *ReliableConn) Recv() (uint16, []byte, error) {
+	for {
+		rc.mu.Lock()
+		if len(rc.messages) > 0 {
+			m := rc.messages[0]
+			rc.messages = rc.messages[1:]
+			rc.deliver()
+			rc.mu.Unlock()
+			return m.channel, m.data, nil
+		}
+		err, deadline := rc.err, rc.readDeadline
+		if err == nil && rc.peerClosed && rc.drained(false) {
+			err = ErrClosed
+		}
+		rc.mu.Unlock()
+
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := rc.wait(rc.messageReady, deadline); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// RTT returns the smoothed round trip time, or zero before the first sample.
+func (rc *ReliableConn) RTT() time.Duration {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.srtt
+}
+
+// Close waits until the peer has acknowledged everything written, or the
+// write deadline passes, and tells it the connection ended. Then it closes
+// the underlying PacketConn.
+func (rc *ReliableConn) Close() error {
+	rc.mu.Lock()
+	if rc.err != nil || rc.closing {
+		rc.mu.Unlock()
+		return ErrClosed
+	}
+	rc.closing = true
+	deadline := rc.writeDeadline
+	rc.mu.Unlock()
+
+	rc.finish(deadline)
+	if !rc.fail(ErrClosed) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// finish waits for the inflight packets to be acknowledged, then sends
+// FlagFin until the peer acknowledges it. It gives up at deadline, once
+// the connection fails, after maxRetries or when the peer closed first.
+func (rc *ReliableConn) finish(deadline time.Time) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	poll := time.NewTicker(resendInterval)
+	defer poll.Stop()
+	for {
+		rc.mu.Lock()
+		waiting := len(rc.inflight) > 0 && !rc.peerClosed
+		rc.mu.Unlock()
+		if !waiting {
+			break
+		}
+		// writable is shared with blocked writers, so poll as well
+		select {
+		case <-rc.writable:
+		case <-poll.C:
+		case <-rc.done:
+			return
+		case <-timeout:
+			return
+		}
+	}
+
+	fin := rc.codec.AppendFrame(nil, Frame{Type: StreamChannel, Flags: FlagFin})
+	for i := 0; i < maxRetries; i++ {
+		rc.mu.Lock()
+		rto, peerClosed := rc.rto, rc.peerClosed
+		rc.mu.Unlock()
+		rc.pc.WriteTo(fin, rc.raddr)
+		if peerClosed {
+			// nobody is left to acknowledge it
+			return
+		}
+		t := time.NewTimer(rto)
+		select {
+		case <-rc.finAcked:
+		case <-rc.done:
+		case <-timeout:
+		case <-t.C:
+			continue
+		}
+		t.Stop()
+		return
+	}
+}
+
+func (rc *ReliableConn) LocalAddr() net.Addr {
+	return rc.pc.LocalAddr()
+}
+
+func (rc *ReliableConn) RemoteAddr() net.Addr {
+	return rc.raddr
+}
+
+func (rc *ReliableConn) SetDeadline(t time.Time) error {
+	rc.SetReadDeadline(t)
+	return rc.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bounds the waiting of Read and Recv.
+func (rc *ReliableConn) SetReadDeadline(t time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline bounds how long Write and Send wait for the send window.
+func (rc *ReliableConn) SetWriteDeadline(t time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.writeDeadline = t
+	return nil
+}
+
+func (rc *ReliableConn) maxPayload() int {
+	return DefaultMTU - FrameHeaderLength
+}
+
+func (rc *ReliableConn) send(channel uint16, payload []byte) error {
+	rc.mu.Lock()
+	for len(rc.inflight) >= reliableWindow && rc.err == nil && !rc.closing && !rc.peerClosed {
+		deadline := rc.writeDeadline
+		rc.mu.Unlock()
+		if err := rc.wait(rc.writable, deadline); err != nil {
+			return err
+		}
+		rc.mu.Lock()
+	}
+	if rc.err != nil {
+		err := rc.err
+		rc.mu.Unlock()
+		return err
+	}
+	if rc.closing || rc.peerClosed {
+		rc.mu.Unlock()
+		return ErrClosed
+	}
+
+	ch := rc.channel(channel)
+	seq := ch.sendSeq
+	ch.sendSeq++
+	datagram := rc.codec.AppendFrame(nil, Frame{Type: channel, Seq: seq, Payload: payload})
+	rc.inflight[inflightKey{channel, seq}] = &inflightPacket{datagram: datagram, sent: time.Now()}
+	rc.mu.Unlock()
+
+	// a lost datagram is resent like a dropped one
+	rc.pc.WriteTo(datagram, rc.raddr)
+	return nil
+}
+
+func (rc *ReliableConn) receiver() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := rc.pc.ReadFrom(buf)
+		if err != nil {
+			rc.fail(err)
+			return
+		}
+		if addr.String() != rc.raddr.String() {
+			continue
+		}
+		f, err := rc.codec.ParseFrame(buf[:n])
+		if err != nil {
+			continue
+		}
+		if f.Flags&FlagFin != 0 {
+			rc.fin(f)
+		} else if f.Flags&FlagAck != 0 {
+			rc.acked(f)
+		} else {
+			rc.received(f)
+		}
+	}
+}
+
+func (rc *ReliableConn) acked(f Frame) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	key := inflightKey{f.Type, f.Seq}
+	p, ok := rc.inflight[key]
+	if !ok {
+		return
+	}
+	delete(rc.inflight, key)
+	if p.retries == 0 {
+		// Karn's algorithm: only packets sent once give a clean sample
+		rc.sampleRTT(time.Since(p.sent))
+	}
+	notify(rc.writable)
+}
+
+// fin handles the FlagFin packet of a closing peer and its acknowledgement.
+func (rc *ReliableConn) fin(f Frame) {
+	if f.Flags&FlagAck != 0 {
+		notify(rc.finAcked)
+		return
+	}
+	rc.mu.Lock()
+	rc.peerClosed = true
+	// the peer reads no more, so stop resending to it
+	rc.inflight = make(map[inflightKey]*inflightPacket)
+	rc.mu.Unlock()
+	notify(rc.streamReady)
+	notify(rc.messageReady)
+	notify(rc.writable)
+
+	ack := rc.codec.AppendFrame(nil, Frame{Type: f.Type, Flags: FlagFin | FlagAck})
+	rc.pc.WriteTo(ack, rc.raddr)
+}
+
+// drained reports whether everything received on the stream channel, or on
+// the message channels, has been delivered. rc.mu must be held.
+func (rc *ReliableConn) drained(stream bool) bool {
+	for id, ch := range rc.channels {
+		if (id == StreamChannel) == stream && len(ch.pending) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleRTT updates the retransmission timeout as in RFC 6298.
+func (rc *ReliableConn) sampleRTT(r time.Duration) {
+	if rc.srtt == 0 {
+		rc.srtt = r
+		rc.rttvar = r / 2
+	} else {
+		d := rc.srtt - r
+		if d < 0 {
+			d = -d
+		}
+		rc.rttvar = (3*rc.rttvar + d) / 4
+		rc.srtt = (7*rc.srtt + r) / 8
+	}
+	rc.rto = rc.srtt + 4*rc.rttvar
+	if rc.rto < minRTO {
+		rc.rto = minRTO
+	}
+	if rc.rto > maxRTO {
+		rc.rto = maxRTO
+	}
+}
+
+func (rc *ReliableConn) received(f Frame) {
+	rc.mu.Lock()
+	if _, ok := rc.channels[f.Type]; !ok && len(rc.channels) >= MaxChannels {
+		rc.mu.Unlock()
+		return
+	}
+	ch := rc.channel(f.Type)
+	d := int32(f.Seq - ch.recvNext)
+	if d >= reliableWindow {
+		// too far ahead to buffer; the peer will resend it
+		rc.mu.Unlock()
+		return
+	}
+	if _, ok := ch.pending[f.Seq]; d >= 0 && !ok {
+		ch.pending[f.Seq] = append([]byte{}, f.Payload...)
+		rc.deliver()
+	}
+	rc.mu.Unlock()
+
+	// duplicates are acknowledged again in case the first ack was lost
+	ack := rc.codec.AppendFrame(nil, Frame{Type: f.Type, Seq: f.Seq, Flags: FlagAck})
+	rc.pc.WriteTo(ack, rc.raddr)
+}
+
+// deliver moves in order packets to the stream and message queues while
+// they have room. rc.mu must be held.
+func (rc *ReliableConn) deliver() {
+	for id, ch := range rc.channels {
+		for {
+			p, ok := ch.pending[ch.recvNext]
+			if !ok {
+				break
+			}
+			if id == StreamChannel {
+				if len(rc.stream) >= maxStreamBuffer {
+					break
+				}
+				rc.stream = append(rc.stream, p...)
+				notify(rc.streamReady)
+			} else {
+				if len(rc.messages) >= maxMessageQueue {
+					break
+				}
+				rc.messages = append(rc.messages, reliableMessage{id, p})
+				notify(rc.messageReady)
+			}
+			delete(ch.pending, ch.recvNext)
+			ch.recvNext++
+		}
+	}
+}
+
+func (rc *ReliableConn) resender() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rc.done:
+			return
+		case <-ticker.C:
+		}
+
+		var resend [][]byte
+		rc.mu.Lock()
+		now := time.Now()
+		for _, p := range rc.inflight {
+			timeout := rc.rto << uint(p.retries)
+			if timeout > maxRTO {
+				timeout = maxRTO
+			}
+			if now.Sub(p.sent) < timeout {
+				continue
+			}
+			if p.retries >= maxRetries {
+				rc.mu.Unlock()
+				rc.fail(ErrPeerTimeout)
+				return
+			}
+			p.retries++
+			p.sent = now
+			resend = append(resend, p.datagram)
+		}
+		rc.mu.Unlock()
+
+		for _, datagram := range resend {
+			rc.pc.WriteTo(datagram, rc.raddr)
+		}
+	}
+}
+
+// channel returns the state of channel id, creating it. rc.mu must be held.
+func (rc *ReliableConn) channel(id uint16) *reliableChannel {
+	ch, ok := rc.channels[id]
+	if !ok {
+		ch = &reliableChannel{pending: make(map[uint32][]byte)}
+		rc.channels[id] = ch
+	}
+	return ch
+}
+
+// wait blocks until ready is signalled, the connection fails or deadline
+// passes. Callers recheck their condition afterwards.
+func (rc *ReliableConn) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ready:
+	case <-rc.done:
+	case <-timeout:
+		return errTimeout
+	}
+	return nil
+}
+
+// fail shuts the connection down with err, reporting whether it was the
+// first failure.
+func (rc *ReliableConn) fail(err error) bool {
+	first := false
+	rc.closeOnce.Do(func() {
+		first = true
+		rc.mu.Lock()
+		rc.err = err
+		rc.mu.Unlock()
+		close(rc.done)
+		rc.pc.Close()
+	})
+	return first
+}
+
+// notify signals ready without blocking.
+func notify(ready chan struct{}) {
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
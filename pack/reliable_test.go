@@ -0,0 +1,197 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn is a PacketConn that drops, delays and so reorders datagrams.
+type lossyConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rnd.Float64() < c.loss
+	delay := time.Duration(c.rnd.Intn(3)) * time.Millisecond
+	c.mu.Unlock()
+
+	if drop {
+		return len(p), nil
+	}
+	if delay > 0 {
+		q := append([]byte(nil), p...)
+		time.AfterFunc(delay, func() { c.PacketConn.WriteTo(q, addr) })
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func newLossyPair(t *testing.T, loss float64) (a, b *ReliableConn) {
+	pa, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no UDP loopback:", err)
+	}
+	pb, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	la := &lossyConn{PacketConn: pa, rnd: rand.New(rand.NewSource(1)), loss: loss}
+	lb := &lossyConn{PacketConn: pb, rnd: rand.New(rand.NewSource(2)), loss: loss}
+	return NewReliableConn(la, pb.LocalAddr()), NewReliableConn(lb, pa.LocalAddr())
+}
+
+func TestReliableStream(t *testing.T) {
+	a, b := newLossyPair(t, 0.2)
+	defer a.Close()
+	defer b.Close()
+
+	// FramedConn runs unchanged on top of the stream channel
+	client, server := NewConn(a), NewConn(b)
+	var messages [][]byte
+	for i := 0; i < 100; i++ {
+		messages = append(messages, bytes.Repeat([]byte{byte(i)}, i*50))
+	}
+	go func() {
+		for _, m := range messages {
+			if err := client.WriteFrame(m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	server.SetReadTimeout(10 * time.Second)
+	for i, want := range messages {
+		got, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("frame %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if a.RTT() <= 0 {
+		t.Fatal("no RTT estimate")
+	}
+}
+
+func TestReliableChannels(t *testing.T) {
+	a, b := newLossyPair(t, 0.2)
+	defer a.Close()
+	defer b.Close()
+
+	const n = 200
+	go func() {
+		for i := 0; i < n; i++ {
+			for ch := uint16(1); ch <= 2; ch++ {
+				if err := a.Send(ch, []byte(fmt.Sprint(i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	next := map[uint16]int{}
+	for i := 0; i < 2*n; i++ {
+		ch, data, err := b.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprint(next[ch]); string(data) != want {
+			t.Fatalf("channel %d: got %q, want %q", ch, data, want)
+		}
+		next[ch]++
+	}
+
+	if err := a.Send(StreamChannel, nil); err != ErrStreamChannel {
+		t.Fatalf("got %v, want ErrStreamChannel", err)
+	}
+	if err := a.Send(1, make([]byte, DefaultMTU)); err != ErrMessageTooLarge {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := b.Recv(); err == nil {
+		t.Fatal("Recv did not time out")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	b.Close()
+	if _, err := b.Read(make([]byte, 1)); err != ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
+
+func TestReliableChannelLimit(t *testing.T) {
+	a, b := newLossyPair(t, 0)
+	defer a.Close()
+	defer b.Close()
+
+	for id := uint16(1); id <= MaxChannels+10; id++ {
+		b.received(Frame{Type: id, Payload: []byte{byte(id)}})
+	}
+	b.mu.Lock()
+	n := len(b.channels)
+	b.mu.Unlock()
+	if n != MaxChannels {
+		t.Fatalf("%d channels, want %d", n, MaxChannels)
+	}
+}
+
+func TestReliableClose(t *testing.T) {
+	a, b := newLossyPair(t, 0.2)
+	defer b.Close()
+
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(3)).Read(data)
+	if n, err := a.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	if err := a.Send(1, []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("Write after Close: got %v, want ErrClosed", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+	if ch, m, err := b.Recv(); err != nil || ch != 1 || string(m) != "bye" {
+		t.Fatalf("Recv: got %d, %q, %v", ch, m, err)
+	}
+	if _, _, err := b.Recv(); err != ErrClosed {
+		t.Fatalf("Recv after the peer closed: got %v, want ErrClosed", err)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("Write after the peer closed: got %v, want ErrClosed", err)
+	}
+
+	start := time.Now()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close after the peer closed took %v", d)
+	}
+}
@@ -0,0 +1,228 @@
+package pack
+
+import "sync"
+
+// DefaultCoalesceSize is how many bytes of small frames a SendQueue gathers
+// into a single write by default.
+const DefaultCoalesceSize = 64 << 10
+
+// Priority is the class of a frame in a SendQueue. Class 0 goes out first.
+type Priority int
+
+// OverflowPolicy decides what Send does when a class is over its budget.
+type OverflowPolicy int
+
+const (
+	// Block waits until the writer has made room.
+	Block OverflowPolicy = iota
+	// Reject fails Send with ErrQueueFull.
+	Reject
+	// DropOldest discards the oldest queued frames of the class, which suits
+	// frames that the next one makes stale, like movement.
+	DropOldest
+	// DropNewest discards the frame being sent.
+	DropNewest
+)
+
+// ClassConfig configures one priority class of a SendQueue.
+type ClassConfig struct {
+	Budget int // bytes of packed frames the class may queue, zero means no limit
+	Policy OverflowPolicy
+}
+
+// QueueStats are the counters of one priority class.
+type QueueStats struct {
+	Frames  int // frames queued now
+	Bytes   int // bytes queued now
+	Peak    int // most bytes ever queued
+	Sent    uint64
+	Dropped uint64
+}
+
+type sendClass struct {
+	ClassConfig
+	frames [][]byte
+	stats  QueueStats
+}
+
+// SendQueue writes frames to a FramedConn in priority order. Each class has
+// its own byte budget, so bulk traffic cannot hold back urgent frames for
+// longer than the write in progress. Queued small frames are coalesced into
+// one write. Send is safe from multiple goroutines.
+type SendQueue struct {
+	fc       *FramedConn
+	coalesce int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	classes []sendClass
+	buf     []byte
+	closed  bool
+	err     error
+	end     chan struct{}
+}
+
+// NewSendQueue starts writing to fc with one priority class per config,
+// the first being the most urgent. fc must not be written to otherwise.
+func NewSendQueue(fc *FramedConn, classes ...ClassConfig) *SendQueue {
+	q := &SendQueue{
+		fc:       fc,
+		coalesce: DefaultCoalesceSize,
+		classes:  make([]sendClass, len(classes)),
+		end:      make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for i, c := range classes {
+		q.classes[i].ClassConfig = c
+	}
+	go q.writer()
+	return q
+}
+
+// SetCoalesceSize sets how many bytes of frames are gathered into one write.
+// A frame larger than n is written on its own.
+func (q *SendQueue) SetCoalesceSize(n int) {
+	q.mu.Lock()
+	q.coalesce = n
+	q.mu.Unlock()
+}
+
+// Send queues message as one frame of class p. A frame larger than the
+// whole budget of its class fails with ErrQueueFull.
+func (q *SendQueue) Send(p Priority, message []byte) error {
+	if int(p) < 0 || int(p) >= len(q.classes) {
+		panic("pack: bad send priority")
+	}
+	packed := q.fc.codec.Pack(message)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := &q.classes[p]
+	if c.Budget > 0 && len(packed) > c.Budget {
+		return ErrQueueFull
+	}
+	for !q.closed && c.Budget > 0 && c.stats.Bytes+len(packed) > c.Budget {
+		switch c.Policy {
+		case Block:
+			q.cond.Wait()
+		case Reject:
+			return ErrQueueFull
+		case DropOldest:
+			c.stats.Bytes -= len(c.frames[0])
+			c.frames[0] = nil
+			c.frames = c.frames[1:]
+			c.stats.Dropped++
+		case DropNewest:
+			c.stats.Dropped++
+			return nil
+		}
+	}
+	if q.closed {
+		if q.err != nil {
+			return q.err
+		}
+		return ErrClosed
+	}
+
+	c.frames = append(c.frames, packed)
+	c.stats.Bytes += len(packed)
+	if c.stats.Bytes > c.stats.Peak {
+		c.stats.Peak = c.stats.Bytes
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Len returns the number of frames queued in all classes.
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for i := range q.classes {
+		n += len(q.classes[i].frames)
+	}
+	return n
+}
+
+// Stats returns the counters of every class, in priority order.
+func (q *SendQueue) Stats() []QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make([]QueueStats, len(q.classes))
+	for i := range q.classes {
+		stats[i] = q.classes[i].stats
+		stats[i].Frames = len(q.classes[i].frames)
+	}
+	return stats
+}
+
+// Close writes out the queued frames and closes the FramedConn. If that
+// takes longer than the FramedConn's close timeout, the remaining frames are
+// dropped and Close returns the error that stopped the writer.
+func (q *SendQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		<-q.end
+		return ErrClosed
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	flushed := q.fc.awaitFlush(q.end)
+	err := q.fc.Close()
+	if !flushed {
+		q.mu.Lock()
+		err = q.err
+		q.mu.Unlock()
+	}
+	return err
+}
+
+func (q *SendQueue) writer() {
+	defer close(q.end)
+	for {
+		q.mu.Lock()
+		batch := q.next()
+		for len(batch) == 0 && !q.closed {
+			q.cond.Wait()
+			batch = q.next()
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := q.fc.writeRaw(batch); err != nil {
+			q.mu.Lock()
+			q.closed, q.err = true, err
+			q.cond.Broadcast()
+			q.mu.Unlock()
+			q.fc.conn.Close()
+			return
+		}
+	}
+}
+
+// next takes frames from the most urgent classes, up to the coalesce size
+// but at least one frame, and returns them as one buffer.
+func (q *SendQueue) next() []byte {
+	q.buf = q.buf[:0]
+	for i := range q.classes {
+		c := &q.classes[i]
+		for len(c.frames) > 0 {
+			f := c.frames[0]
+			if len(q.buf) > 0 && len(q.buf)+len(f) > q.coalesce {
+				return q.buf
+			}
+			q.buf = append(q.buf, f...)
+			c.frames[0] = nil
+			c.frames = c.frames[1:]
+			c.stats.Bytes -= len(f)
+			c.stats.Sent++
+		}
+	}
+	return q.buf
+}
@@ -0,0 +1,122 @@
+package pack
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrTooManyResyncs reports a stream that lost frame alignment more often
+// than allowed by SetMaxResyncs. It is permanent.
+var ErrTooManyResyncs = errors.New("pack: too many resyncs")
+
+// Stats counts what a stateful unpacker has seen on its stream.
+type Stats struct {
+	Frames    uint64 // frames decoded
+	Bytes     uint64 // bytes consumed, including skipped ones
+	Skipped   uint64 // garbage bytes discarded while looking for a frame
+	Resyncs   uint64 // times the stream lost frame alignment
+	Malformed uint64 // frames rejected with ErrBadLength, ErrFrameTooLarge or ErrChecksum
+}
+
+// tracker wraps Codec.scan for Decoder and Unpacker, keeping Stats.
+type tracker struct {
+	codec *Codec
+
+	mu         sync.Mutex
+	stats      Stats
+	maxResyncs uint64
+	lost       bool // skipping garbage since the last good frame
+}
+
+// scan is Codec.scan with bookkeeping. Once the resync limit is exceeded it
+// consumes nothing and returns ErrTooManyResyncs.
+func (t *tracker) scan(buffer []byte) ([]byte, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxResyncs > 0 && t.stats.Resyncs > t.maxResyncs {
+		return nil, 0, ErrTooManyResyncs
+	}
+
+	data, skipped, n, err := t.codec.scan(buffer)
+	t.stats.Bytes += uint64(n)
+	t.stats.Skipped += uint64(skipped)
+	if skipped > 0 && !t.lost {
+		t.lost = true
+		t.stats.Resyncs++
+	}
+	switch err {
+	case nil:
+		t.stats.Frames++
+		t.lost = false
+	case errIncomplete:
+	default:
+		t.stats.Malformed++
+	}
+	if t.maxResyncs > 0 && t.stats.Resyncs > t.maxResyncs {
+		return nil, n, ErrTooManyResyncs
+	}
+	return data, n, err
+}
+
+// Stats returns a snapshot of the counters. It is safe to call concurrently
+// with decoding.
+func (t *tracker) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// SetMaxResyncs makes decoding fail with ErrTooManyResyncs once the stream
+// has lost alignment more than n times. Zero means no limit.
+func (t *tracker) SetMaxResyncs(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxResyncs = uint64(n)
+}
+
+// Unpacker is a stateful Unpack: it keeps the leftover bytes between calls
+// and counts Stats.
+type Unpacker struct {
+	tracker
+	buf []byte
+}
+
+// NewUnpacker returns an Unpacker using DefaultCodec.
+func NewUnpacker() *Unpacker {
+	return DefaultCodec.NewUnpacker()
+}
+
+// NewUnpacker returns an Unpacker using c.
+func (c *Codec) NewUnpacker() *Unpacker {
+	return &Unpacker{tracker: tracker{codec: c}}
+}
+
+// Feed appends data to the buffered bytes and calls fn for every complete
+// frame, stopping at the first error from fn or the codec. The slice passed
+// to fn is only valid during the call.
+func (u *Unpacker) Feed(data []byte, fn func([]byte) error) error {
+	u.buf = append(u.buf, data...)
+	off := 0
+	defer func() {
+		u.buf = u.buf[:copy(u.buf, u.buf[off:])]
+	}()
+
+	for {
+		frame, n, err := u.scan(u.buf[off:])
+		off += n
+		if err == errIncomplete {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Buffered returns the number of bytes waiting for the rest of their frame.
+func (u *Unpacker) Buffered() int {
+	return len(u.buf)
+}